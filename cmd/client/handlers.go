@@ -1,25 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func HandlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
+func HandlerPause(gs *gamelogic.GameState) pubsub.Handler[routing.PlayingState] {
 	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
 		gs.HandlePause(ps)
 		return pubsub.Ack
 	}
 }
 
-func HandlerMove(ch *amqp.Channel, gs *gamelogic.GameState) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(mv gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
+func HandlerMove(pub pubsub.Publisher, gs *gamelogic.GameState) pubsub.MessageHandler[gamelogic.ArmyMove] {
+	return func(ctx context.Context, msg pubsub.Message[gamelogic.ArmyMove]) pubsub.AckType {
+		mv := msg.Body
 		move := gs.HandleMove(mv)
 		switch move {
 		case gamelogic.MoveOutcomeSafe:
@@ -30,10 +30,16 @@ func HandlerMove(ch *amqp.Channel, gs *gamelogic.GameState) func(gamelogic.ArmyM
 			data := gamelogic.RecognitionOfWar{
 				Attacker: mv.Player,
 				Defender: gs.GetPlayerSnap()}
-			err := pubsub.PublishJSON(ch, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+"."+gs.GetUsername(), data)
+			err := pubsub.Publish(ctx, pub, pubsub.JSON, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+"."+gs.GetUsername(), data,
+				pubsub.WithSender(gs.GetUsername()), pubsub.WithCorrelationID(msg.MessageID))
+			var returned *pubsub.ReturnError
+			if errors.As(err, &returned) {
+				fmt.Printf("Recognition of war was not routed to any queue: %v\n", returned.ReplyText)
+				return pubsub.NackRetry
+			}
 			if err != nil {
 				fmt.Printf("Error publishing recognition of war: %v\n", err)
-				return pubsub.NackRequeue
+				return pubsub.NackRetry
 			}
 			return pubsub.Ack
 		default:
@@ -42,34 +48,36 @@ func HandlerMove(ch *amqp.Channel, gs *gamelogic.GameState) func(gamelogic.ArmyM
 	}
 }
 
-func HandlerWarOutcome(ch *amqp.Channel, gs *gamelogic.GameState) func(gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(rw gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
-		outcome, winner, loser := gs.HandleWar(rw)
+func HandlerWarOutcome(pub pubsub.Publisher, gs *gamelogic.GameState) pubsub.MessageHandler[gamelogic.RecognitionOfWar] {
+	return func(ctx context.Context, msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.AckType {
+		if ctx.Err() != nil {
+			return pubsub.NackRequeue
+		}
+		outcome, winner, loser := gs.HandleWar(msg.Body)
 		switch outcome {
 		case gamelogic.WarOutcomeNotInvolved:
 			return pubsub.NackRequeue
 		case gamelogic.WarOutcomeNoUnits:
 			return pubsub.NackDiscard
 		case gamelogic.WarOutcomeOpponentWon:
-			msg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			err := pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+			log := fmt.Sprintf("%s won a war against %s", winner, loser)
+			err := pubsub.PublishGameLog(ctx, pub, gs.GetUsername(), log, pubsub.WithCorrelationID(msg.MessageID))
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.NackRetry
 			}
 			return pubsub.Ack
 		case gamelogic.WarOutcomeYouWon:
-			msg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			err := pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+			log := fmt.Sprintf("%s won a war against %s", winner, loser)
+			err := pubsub.PublishGameLog(ctx, pub, gs.GetUsername(), log, pubsub.WithCorrelationID(msg.MessageID))
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.NackRetry
 			}
 			return pubsub.Ack
 		case gamelogic.WarOutcomeDraw:
-			msg := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
-			err := pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+			log := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+			err := pubsub.PublishGameLog(ctx, pub, gs.GetUsername(), log, pubsub.WithCorrelationID(msg.MessageID))
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.NackRetry
 			}
 			return pubsub.Ack
 		default:
@@ -78,3 +86,9 @@ func HandlerWarOutcome(ch *amqp.Channel, gs *gamelogic.GameState) func(gamelogic
 		}
 	}
 }
+
+func HandlerStatus(gs *gamelogic.GameState) func(context.Context, pubsub.Message[struct{}]) (gamelogic.Player, error) {
+	return func(ctx context.Context, msg pubsub.Message[struct{}]) (gamelogic.Player, error) {
+		return gs.GetPlayerSnap(), nil
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func startClient(t *testing.T, b *pubsub.MemoryBroker, username string) *gamelogic.GameState {
+	t.Helper()
+	ctx := context.Background()
+	gs := gamelogic.NewGameState(username)
+	confirmPub := b.NewConfirmPublisher(true, time.Second)
+
+	movesSub, err := pubsub.Subscribe(ctx, b, routing.ExchangePerilTopic, "army_moves."+username, routing.ArmyMovesPrefix+".*", pubsub.QueueTransient, pubsub.Chain(HandlerMove(confirmPub, gs), pubsub.Recover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { movesSub.Close() })
+
+	warSub, err := pubsub.Subscribe(ctx, b, routing.ExchangePerilTopic, "war", routing.WarRecognitionsPrefix+".*", pubsub.QueueDurable, pubsub.Chain(HandlerWarOutcome(b, gs), pubsub.Recover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { warSub.Close() })
+	return gs
+}
+
+func TestMoveIntoOpponentStartsWar(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	err := pubsub.DeclareTopology(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeclareQueue(pubsub.QueueSpec{Name: "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.BindQueue("logs", routing.GameLogSlug+".*", routing.ExchangePerilTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := startClient(t, b, "alice")
+	bob := startClient(t, b, "bob")
+	err = alice.CommandSpawn([]string{"spawn", "europe", "infantry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.CommandSpawn([]string{"spawn", "asia", "infantry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mv, err := bob.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pubsub.Publish(context.Background(), b, pubsub.Protobuf, routing.ExchangePerilTopic, "army_moves.bob", mv, pubsub.WithSender("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		d, ok, err := b.Get("logs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		d.Ack()
+		var log routing.GameLog
+		err = pubsub.Gob.Unmarshal(d.Body, &log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Alice declared the war, so only bob as the attacker resolves it.
+		if log.Username != "bob" || d.RoutingKey != routing.GameLogSlug+".bob" {
+			t.Errorf("log from %s on %s, want bob", log.Username, d.RoutingKey)
+		}
+		if !strings.Contains(log.Message, "draw") {
+			t.Errorf("log %q, want a draw between two infantry", log.Message)
+		}
+		return
+	}
+	t.Fatal("no war was resolved")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/perilpb"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func handleDLQ(ctx context.Context, dlq *pubsub.DeadLetterQueue, words []string) {
+	if len(words) < 2 {
+		fmt.Println("Usage: dlq list | dlq show <n> | dlq replay <n|all> | dlq purge")
+		return
+	}
+	switch words[1] {
+	case "list":
+		letters, err := dlq.List(0)
+		if err != nil {
+			fmt.Printf("Error listing dead letters: %v\n", err)
+			return
+		}
+		if len(letters) == 0 {
+			fmt.Println("The dead-letter queue is empty.")
+			return
+		}
+		for i, d := range letters {
+			exchange, key := d.Origin()
+			fmt.Printf("%d: %s %s (%s, %d bytes) %s\n", i+1, exchange, key, d.ContentType, len(d.Body), deathReason(d))
+		}
+	case "show":
+		n, ok := parseIndex(words)
+		if !ok {
+			return
+		}
+		letters, err := dlq.List(n)
+		if err != nil {
+			fmt.Printf("Error listing dead letters: %v\n", err)
+			return
+		}
+		if n > len(letters) {
+			fmt.Printf("There is no dead letter #%d.\n", n)
+			return
+		}
+		printDeadLetter(letters[n-1])
+	case "replay":
+		if len(words) > 2 && words[2] == "all" {
+			count, err := dlq.ReplayAll(ctx)
+			if err != nil {
+				fmt.Printf("Error replaying dead letters: %v\n", err)
+			}
+			fmt.Printf("Replayed %d dead letter(s).\n", count)
+			return
+		}
+		n, ok := parseIndex(words)
+		if !ok {
+			return
+		}
+		err := dlq.Replay(ctx, n)
+		if err != nil {
+			fmt.Printf("Error replaying dead letter: %v\n", err)
+			return
+		}
+		fmt.Printf("Replayed dead letter #%d.\n", n)
+	case "purge":
+		count, err := dlq.Purge()
+		if err != nil {
+			fmt.Printf("Error purging dead letters: %v\n", err)
+			return
+		}
+		fmt.Printf("Purged %d dead letter(s).\n", count)
+	default:
+		fmt.Println("Sorry, I don't understand that dlq command.")
+	}
+}
+
+func parseIndex(words []string) (int, bool) {
+	if len(words) < 3 {
+		fmt.Printf("Usage: dlq %s <n>\n", words[1])
+		return 0, false
+	}
+	n, err := strconv.Atoi(words[2])
+	if err != nil || n < 1 {
+		fmt.Println("Not a valid number.")
+		return 0, false
+	}
+	return n, true
+}
+
+func deathReason(d pubsub.DeadLetter) string {
+	if reason, ok := d.Headers[pubsub.HeaderFailureReason].(string); ok {
+		return reason
+	}
+	if len(d.Deaths) > 0 {
+		return fmt.Sprintf("%s from %s", d.Deaths[0].Reason, d.Deaths[0].Queue)
+	}
+	return ""
+}
+
+func printDeadLetter(d pubsub.DeadLetter) {
+	exchange, key := d.Origin()
+	fmt.Printf("Exchange: %s\n", exchange)
+	fmt.Printf("Routing key: %s\n", key)
+	fmt.Printf("Content type: %s\n", d.ContentType)
+	env := pubsub.EnvelopeOf(d.Delivery)
+	if env.Type != "" {
+		fmt.Printf("Type: %s v%d\n", env.Type, env.Version)
+		fmt.Printf("Message ID: %s\n", env.MessageID)
+		fmt.Printf("Sender: %s at %v\n", env.Sender, env.Timestamp)
+	}
+	for _, death := range d.Deaths {
+		fmt.Printf("x-death: %s from %s (%d time(s), last at %v) via %s %s\n",
+			death.Reason, death.Queue, death.Count, death.Time, death.Exchange, strings.Join(death.RoutingKeys, ","))
+	}
+	if reason, ok := d.Headers[pubsub.HeaderFailureReason].(string); ok {
+		fmt.Printf("Failure reason: %s\n", reason)
+	}
+	fmt.Println("Body:")
+	fmt.Println(decodeBody(d.ContentType, key, d.Body))
+}
+
+func decodeBody(contentType, key string, body []byte) string {
+	switch contentType {
+	case "application/json":
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err != nil {
+			return fmt.Sprintf("invalid JSON (%v): %q", err, body)
+		}
+		return out.String()
+	case "application/gob":
+		if !strings.HasPrefix(key, routing.GameLogSlug+".") {
+			return fmt.Sprintf("%d bytes of gob with no known type for %q", len(body), key)
+		}
+		var gl routing.GameLog
+		if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&gl); err != nil {
+			return fmt.Sprintf("invalid gob (%v)", err)
+		}
+		return fmt.Sprintf("%+v", gl)
+	case "application/msgpack":
+		var v any
+		if err := pubsub.MsgPack.Unmarshal(body, &v); err != nil {
+			return fmt.Sprintf("invalid msgpack (%v)", err)
+		}
+		return fmt.Sprintf("%+v", v)
+	case "application/x-protobuf":
+		var msg proto.Message
+		switch {
+		case strings.HasPrefix(key, routing.ArmyMovesPrefix+"."):
+			msg = &perilpb.ArmyMove{}
+		case strings.HasPrefix(key, routing.WarRecognitionsPrefix+"."):
+			msg = &perilpb.RecognitionOfWar{}
+		case strings.HasPrefix(key, routing.GameLogSlug+"."):
+			msg = &perilpb.GameLog{}
+		case key == routing.PauseKey:
+			msg = &perilpb.PlayingState{}
+		default:
+			return fmt.Sprintf("%d bytes of protobuf with no known type for %q", len(body), key)
+		}
+		if err := proto.Unmarshal(body, msg); err != nil {
+			return fmt.Sprintf("invalid protobuf (%v)", err)
+		}
+		return protojson.Format(msg)
+	default:
+		return fmt.Sprintf("%q", body)
+	}
+}
@@ -71,6 +71,8 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		unitIDs = append(unitIDs, unitID)
 	}
 
+	// Look every unit up before moving any, so a bad ID leaves the state as
+	// it was.
 	newUnits := []Unit{}
 	for _, unitID := range unitIDs {
 		unit, ok := gs.GetUnit(unitID)
@@ -78,9 +80,11 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
 		unit.Location = newLocation
-		gs.UpdateUnit(unit)
 		newUnits = append(newUnits, unit)
 	}
+	for _, unit := range newUnits {
+		gs.UpdateUnit(unit)
+	}
 
 	mv := ArmyMove{
 		ToLocation: newLocation,
@@ -0,0 +1,131 @@
+// Package perilpb holds the protobuf definitions of the Peril messages.
+// Importing it registers conversions so the pubsub protobuf codec can carry
+// the gamelogic and routing types directly.
+package perilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative peril.proto
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func init() {
+	pubsub.RegisterProtoMapping(FromArmyMove, (*ArmyMove).ToGame)
+	pubsub.RegisterProtoMapping(FromRecognitionOfWar, (*RecognitionOfWar).ToGame)
+	pubsub.RegisterProtoMapping(FromPlayingState, (*PlayingState).ToRouting)
+	pubsub.RegisterProtoMapping(FromGameLog, (*GameLog).ToRouting)
+}
+
+var ranks = map[gamelogic.UnitRank]UnitRank{
+	gamelogic.RankInfantry:  UnitRank_UNIT_RANK_INFANTRY,
+	gamelogic.RankCavalry:   UnitRank_UNIT_RANK_CAVALRY,
+	gamelogic.RankArtillery: UnitRank_UNIT_RANK_ARTILLERY,
+}
+
+func FromUnit(u gamelogic.Unit) *Unit {
+	return &Unit{
+		Id:       int64(u.ID),
+		Rank:     ranks[u.Rank],
+		Location: string(u.Location),
+	}
+}
+
+func (u *Unit) ToGame() gamelogic.Unit {
+	unit := gamelogic.Unit{
+		ID:       int(u.GetId()),
+		Location: gamelogic.Location(u.GetLocation()),
+	}
+	for rank, r := range ranks {
+		if r == u.GetRank() {
+			unit.Rank = rank
+		}
+	}
+	return unit
+}
+
+func FromPlayer(p gamelogic.Player) *Player {
+	units := make(map[int64]*Unit, len(p.Units))
+	for id, u := range p.Units {
+		units[int64(id)] = FromUnit(u)
+	}
+	return &Player{
+		Username: p.Username,
+		Units:    units,
+	}
+}
+
+func (p *Player) ToGame() gamelogic.Player {
+	units := make(map[int]gamelogic.Unit, len(p.GetUnits()))
+	for id, u := range p.GetUnits() {
+		units[int(id)] = u.ToGame()
+	}
+	return gamelogic.Player{
+		Username: p.GetUsername(),
+		Units:    units,
+	}
+}
+
+func FromArmyMove(m gamelogic.ArmyMove) *ArmyMove {
+	units := make([]*Unit, len(m.Units))
+	for i, u := range m.Units {
+		units[i] = FromUnit(u)
+	}
+	return &ArmyMove{
+		Player:     FromPlayer(m.Player),
+		Units:      units,
+		ToLocation: string(m.ToLocation),
+	}
+}
+
+func (m *ArmyMove) ToGame() gamelogic.ArmyMove {
+	units := make([]gamelogic.Unit, len(m.GetUnits()))
+	for i, u := range m.GetUnits() {
+		units[i] = u.ToGame()
+	}
+	return gamelogic.ArmyMove{
+		Player:     m.GetPlayer().ToGame(),
+		Units:      units,
+		ToLocation: gamelogic.Location(m.GetToLocation()),
+	}
+}
+
+func FromRecognitionOfWar(rw gamelogic.RecognitionOfWar) *RecognitionOfWar {
+	return &RecognitionOfWar{
+		Attacker: FromPlayer(rw.Attacker),
+		Defender: FromPlayer(rw.Defender),
+	}
+}
+
+func (rw *RecognitionOfWar) ToGame() gamelogic.RecognitionOfWar {
+	return gamelogic.RecognitionOfWar{
+		Attacker: rw.GetAttacker().ToGame(),
+		Defender: rw.GetDefender().ToGame(),
+	}
+}
+
+func FromPlayingState(ps routing.PlayingState) *PlayingState {
+	return &PlayingState{IsPaused: ps.IsPaused}
+}
+
+func (ps *PlayingState) ToRouting() routing.PlayingState {
+	return routing.PlayingState{IsPaused: ps.GetIsPaused()}
+}
+
+func FromGameLog(gl routing.GameLog) *GameLog {
+	return &GameLog{
+		CurrentTime: timestamppb.New(gl.CurrentTime),
+		Message:     gl.Message,
+		Username:    gl.Username,
+	}
+}
+
+func (gl *GameLog) ToRouting() routing.GameLog {
+	return routing.GameLog{
+		CurrentTime: gl.GetCurrentTime().AsTime(),
+		Message:     gl.GetMessage(),
+		Username:    gl.GetUsername(),
+	}
+}
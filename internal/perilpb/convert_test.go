@@ -0,0 +1,139 @@
+package perilpb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/proto"
+)
+
+func roundTrip[T any](t *testing.T, in T) T {
+	t.Helper()
+	data, err := pubsub.Protobuf.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out T
+	err = pubsub.Protobuf.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return out
+}
+
+func TestProtobufRoundTripsGameTypes(t *testing.T) {
+	player := gamelogic.Player{
+		Username: "alice",
+		Units: map[int]gamelogic.Unit{
+			1:          {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+			7:          {ID: 7, Rank: gamelogic.RankCavalry, Location: "africa"},
+			1<<40 + 42: {ID: 1<<40 + 42, Rank: gamelogic.RankArtillery, Location: "asia"},
+		},
+	}
+	move := gamelogic.ArmyMove{
+		Player:     player,
+		Units:      []gamelogic.Unit{player.Units[7], player.Units[1<<40+42]},
+		ToLocation: "europe",
+	}
+	if got := roundTrip(t, move); !reflect.DeepEqual(got, move) {
+		t.Errorf("ArmyMove: got %+v, want %+v", got, move)
+	}
+
+	war := gamelogic.RecognitionOfWar{Attacker: player, Defender: gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{}}}
+	if got := roundTrip(t, war); !reflect.DeepEqual(got, war) {
+		t.Errorf("RecognitionOfWar: got %+v, want %+v", got, war)
+	}
+
+	state := routing.PlayingState{IsPaused: true}
+	if got := roundTrip(t, state); got != state {
+		t.Errorf("PlayingState: got %+v, want %+v", got, state)
+	}
+}
+
+func TestUnitRankMapping(t *testing.T) {
+	cases := []struct {
+		game  gamelogic.UnitRank
+		proto UnitRank
+	}{
+		{gamelogic.RankInfantry, UnitRank_UNIT_RANK_INFANTRY},
+		{gamelogic.RankCavalry, UnitRank_UNIT_RANK_CAVALRY},
+		{gamelogic.RankArtillery, UnitRank_UNIT_RANK_ARTILLERY},
+		{"", UnitRank_UNIT_RANK_UNSPECIFIED},
+	}
+	for _, c := range cases {
+		if got := FromUnit(gamelogic.Unit{Rank: c.game}).GetRank(); got != c.proto {
+			t.Errorf("FromUnit(%q) rank = %v, want %v", c.game, got, c.proto)
+		}
+		if got := (&Unit{Rank: c.proto}).ToGame().Rank; got != c.game {
+			t.Errorf("ToGame(%v) rank = %q, want %q", c.proto, got, c.game)
+		}
+	}
+
+	// A rank this build doesn't know, in either direction, is unspecified.
+	if got := FromUnit(gamelogic.Unit{Rank: "general"}).GetRank(); got != UnitRank_UNIT_RANK_UNSPECIFIED {
+		t.Errorf("unknown rank encoded as %v", got)
+	}
+	if got := (&Unit{Rank: UnitRank(99)}).ToGame().Rank; got != "" {
+		t.Errorf("unknown proto rank decoded as %q", got)
+	}
+}
+
+func TestPlayerUnitsKeyedByInt64(t *testing.T) {
+	p := FromPlayer(gamelogic.Player{
+		Username: "alice",
+		Units:    map[int]gamelogic.Unit{1 << 40: {ID: 1 << 40, Rank: gamelogic.RankCavalry}},
+	})
+	data, err := proto.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Player
+	err = proto.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, ok := got.GetUnits()[1<<40]
+	if !ok || u.GetId() != 1<<40 || u.GetRank() != UnitRank_UNIT_RANK_CAVALRY {
+		t.Errorf("units = %v, want unit %d under its own ID", got.GetUnits(), int64(1<<40))
+	}
+}
+
+func TestGameLogTimeThroughTimestamp(t *testing.T) {
+	log := routing.GameLog{
+		CurrentTime: time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.FixedZone("CET", 3600)),
+		Message:     "alice won a war against bob",
+		Username:    "alice",
+	}
+	pb := FromGameLog(log)
+	if pb.GetCurrentTime().GetSeconds() != log.CurrentTime.Unix() || pb.GetCurrentTime().GetNanos() != 123456789 {
+		t.Errorf("timestamp = %v, want %v", pb.GetCurrentTime(), log.CurrentTime)
+	}
+	got := roundTrip(t, log)
+	if !got.CurrentTime.Equal(log.CurrentTime) || got.Message != log.Message || got.Username != log.Username {
+		t.Errorf("GameLog: got %+v, want %+v", got, log)
+	}
+}
+
+func TestUnmarshalIntoMessagePointer(t *testing.T) {
+	in := &ArmyMove{
+		Player:     &Player{Username: "alice"},
+		Units:      []*Unit{{Id: 3, Rank: UnitRank_UNIT_RANK_ARTILLERY, Location: "asia"}},
+		ToLocation: "europe",
+	}
+	data, err := pubsub.Protobuf.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out *ArmyMove
+	err = pubsub.Protobuf.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, in) {
+		t.Errorf("got %v, want %v", out, in)
+	}
+}
@@ -0,0 +1,1017 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateDisconnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type AMQPOption func(*AMQPBroker)
+
+func WithStateHandler(fn func(state ConnState, err error)) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.onState = fn
+	}
+}
+
+func WithTLS(cfg *tls.Config) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.config.TLSClientConfig = cfg
+	}
+}
+
+// WithVhost overrides the virtual host given in the URL.
+func WithVhost(vhost string) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.config.Vhost = vhost
+	}
+}
+
+func WithHeartbeat(d time.Duration) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.config.Heartbeat = d
+	}
+}
+
+// WithConnectionName sets the name the connection is listed under in the
+// RabbitMQ management UI.
+func WithConnectionName(name string) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.config.Properties.SetClientConnectionName(name)
+	}
+}
+
+func WithBackoff(initial, max time.Duration) AMQPOption {
+	return func(b *AMQPBroker) {
+		b.initialBackoff = initial
+		b.maxBackoff = max
+	}
+}
+
+// AMQPBroker keeps a connection to RabbitMQ alive. When the connection drops
+// it redials with exponential backoff, replays every queue declaration and
+// binding made through it, and resumes its consumers.
+type AMQPBroker struct {
+	url            string
+	config         amqp.Config
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	onState        func(ConnState, error)
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	pubCh     *amqp.Channel
+	getCh     *amqp.Channel
+	changed   chan struct{}
+	done      chan struct{}
+	closed    bool
+	exchanges []ExchangeSpec
+	queues    map[string]QueueSpec
+	queueList []string
+	bindings  []amqpBinding
+	consumers map[string]int
+}
+
+type amqpBinding struct {
+	queue    string
+	key      string
+	exchange string
+}
+
+func DialAMQP(url string, opts ...AMQPOption) (*AMQPBroker, error) {
+	b := &AMQPBroker{
+		url: url,
+		config: amqp.Config{
+			Heartbeat:  10 * time.Second,
+			Locale:     "en_US",
+			Properties: amqp.NewConnectionProperties(),
+		},
+		initialBackoff: 500 * time.Millisecond,
+		maxBackoff:     30 * time.Second,
+		changed:        make(chan struct{}),
+		done:           make(chan struct{}),
+		queues:         map[string]QueueSpec{},
+		consumers:      map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	conn := b.conn
+	b.conn = nil
+	b.pubCh = nil
+	b.getCh = nil
+	b.notifyChangedLocked()
+	b.mu.Unlock()
+
+	b.setState(StateClosed, nil)
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (b *AMQPBroker) connect() error {
+	conn, err := amqp.DialConfig(b.url, b.config)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	queues := make([]QueueSpec, 0, len(b.queueList))
+	for _, name := range b.queueList {
+		queues = append(queues, b.queues[name])
+	}
+	exchanges := append([]ExchangeSpec(nil), b.exchanges...)
+	bindings := append([]amqpBinding(nil), b.bindings...)
+	b.mu.Unlock()
+
+	err = redeclare(conn, exchanges, queues, bindings)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		conn.Close()
+		return ErrNotConnected
+	}
+	b.conn = conn
+	b.pubCh = pubCh
+	b.notifyChangedLocked()
+	b.mu.Unlock()
+
+	b.setState(StateConnected, nil)
+	go b.watch(conn)
+	return nil
+}
+
+func redeclare(conn *amqp.Connection, exchanges []ExchangeSpec, queues []QueueSpec, bindings []amqpBinding) error {
+	if len(exchanges) == 0 && len(queues) == 0 && len(bindings) == 0 {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, spec := range exchanges {
+		err := ch.ExchangeDeclare(spec.Name, spec.Kind, spec.Durable, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, spec := range queues {
+		_, err := ch.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, toAMQPTable(spec.Args))
+		if err != nil {
+			return err
+		}
+	}
+	for _, bind := range bindings {
+		err := ch.QueueBind(bind.queue, bind.key, bind.exchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *AMQPBroker) watch(conn *amqp.Connection) {
+	closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+	var cause error
+	select {
+	case amqpErr := <-closeCh:
+		if amqpErr != nil {
+			cause = amqpErr
+		}
+	case <-b.done:
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.conn = nil
+	b.pubCh = nil
+	b.getCh = nil
+	b.notifyChangedLocked()
+	b.mu.Unlock()
+
+	b.setState(StateDisconnected, cause)
+	b.reconnect()
+}
+
+func (b *AMQPBroker) reconnect() {
+	delay := b.initialBackoff
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(delay):
+		}
+
+		b.setState(StateReconnecting, nil)
+		err := b.connect()
+		if err == nil {
+			return
+		}
+		b.setState(StateDisconnected, err)
+
+		delay *= 2
+		if delay > b.maxBackoff {
+			delay = b.maxBackoff
+		}
+	}
+}
+
+func (b *AMQPBroker) setState(state ConnState, err error) {
+	if b.onState != nil {
+		b.onState(state, err)
+	}
+}
+
+func (b *AMQPBroker) notifyChangedLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *AMQPBroker) currentConn() (*amqp.Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil, ErrNotConnected
+	}
+	return b.conn, nil
+}
+
+// waitForConnection blocks until a connection other than prev is available.
+// It reports false once the broker has been closed or stop fires.
+func (b *AMQPBroker) waitForConnection(prev *amqp.Connection, stop <-chan struct{}) (*amqp.Connection, bool) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return nil, false
+		}
+		if b.conn != nil && b.conn != prev {
+			conn := b.conn
+			b.mu.Unlock()
+			return conn, true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-stop:
+			return nil, false
+		}
+	}
+}
+
+func (b *AMQPBroker) publishChannel() (*amqp.Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil, ErrNotConnected
+	}
+	if b.pubCh == nil || b.pubCh.IsClosed() {
+		ch, err := b.conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		b.pubCh = ch
+	}
+	return b.pubCh, nil
+}
+
+func (b *AMQPBroker) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	ch, err := b.publishChannel()
+	if err != nil {
+		return err
+	}
+	return ch.PublishWithContext(ctx, exchange, key, false, false, toAMQPPublishing(msg))
+}
+
+func (b *AMQPBroker) DeclareExchange(spec ExchangeSpec) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(spec.Name, spec.Kind, spec.Durable, false, false, false, nil)
+	})
+	if err != nil {
+		return topologyError("exchange", spec.Name, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, existing := range b.exchanges {
+		if existing.Name == spec.Name {
+			b.exchanges[i] = spec
+			return nil
+		}
+	}
+	b.exchanges = append(b.exchanges, spec)
+	return nil
+}
+
+// CheckExchange first declares passively to see whether the exchange exists,
+// then redeclares it with the expected settings on a fresh channel. Since it
+// already exists that second declare creates nothing, but the broker rejects it
+// with PRECONDITION_FAILED if the settings differ.
+func (b *AMQPBroker) CheckExchange(spec ExchangeSpec) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(spec.Name, spec.Kind, spec.Durable, false, false, false, nil)
+	})
+	if err == nil {
+		err = b.withChannel(func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(spec.Name, spec.Kind, spec.Durable, false, false, false, nil)
+		})
+	}
+	return topologyError("exchange", spec.Name, err)
+}
+
+func (b *AMQPBroker) CheckQueue(spec QueueSpec) (Queue, error) {
+	var q amqp.Queue
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		var err error
+		q, err = ch.QueueDeclarePassive(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, toAMQPTable(spec.Args))
+		return err
+	})
+	if err == nil {
+		err = b.withChannel(func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, toAMQPTable(spec.Args))
+			return err
+		})
+	}
+	return Queue{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, topologyError("queue", spec.Name, err)
+}
+
+func (b *AMQPBroker) withChannel(fn func(ch *amqp.Channel) error) error {
+	conn, err := b.currentConn()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func topologyError(kind, name string, err error) error {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return err
+	}
+	switch amqpErr.Code {
+	case amqp.NotFound:
+		return fmt.Errorf("%s %q: %w", kind, name, ErrNotFound)
+	case amqp.PreconditionFailed:
+		return fmt.Errorf("%s %q: %w: %v", kind, name, ErrInequivalent, amqpErr.Reason)
+	default:
+		return err
+	}
+}
+
+func (b *AMQPBroker) DeclareQueue(spec QueueSpec) (Queue, error) {
+	var q amqp.Queue
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		var err error
+		q, err = ch.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, toAMQPTable(spec.Args))
+		return err
+	})
+	if err != nil {
+		return Queue{}, topologyError("queue", spec.Name, err)
+	}
+
+	if spec.Name != "" {
+		b.mu.Lock()
+		if _, ok := b.queues[spec.Name]; !ok {
+			b.queueList = append(b.queueList, spec.Name)
+		}
+		b.queues[spec.Name] = spec
+		b.mu.Unlock()
+	}
+	return Queue{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, nil
+}
+
+func (b *AMQPBroker) BindQueue(queueName, key, exchange string) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return ch.QueueBind(queueName, key, exchange, false, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	bind := amqpBinding{queue: queueName, key: key, exchange: exchange}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, existing := range b.bindings {
+		if existing == bind {
+			return nil
+		}
+	}
+	b.bindings = append(b.bindings, bind)
+	return nil
+}
+
+// ForgetQueue stops redeclaring queueName and its bindings on reconnect. A
+// queue is forgotten when the last consumer on it closes.
+func (b *AMQPBroker) ForgetQueue(queueName string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forgetQueueLocked(queueName)
+}
+
+func (b *AMQPBroker) forgetQueueLocked(queueName string) {
+	delete(b.queues, queueName)
+	b.queueList = slices.DeleteFunc(b.queueList, func(name string) bool {
+		return name == queueName
+	})
+	b.bindings = slices.DeleteFunc(b.bindings, func(bind amqpBinding) bool {
+		return bind.queue == queueName
+	})
+}
+
+func (b *AMQPBroker) Get(queueName string) (Delivery, bool, error) {
+	b.mu.Lock()
+	if b.conn == nil {
+		b.mu.Unlock()
+		return Delivery{}, false, ErrNotConnected
+	}
+	if b.getCh == nil || b.getCh.IsClosed() {
+		ch, err := b.conn.Channel()
+		if err != nil {
+			b.mu.Unlock()
+			return Delivery{}, false, err
+		}
+		b.getCh = ch
+	}
+	ch := b.getCh
+	b.mu.Unlock()
+
+	msg, ok, err := ch.Get(queueName, false)
+	if err != nil {
+		return Delivery{}, false, topologyError("queue", queueName, err)
+	}
+	if !ok {
+		return Delivery{}, false, nil
+	}
+	return fromAMQPDelivery(msg), true, nil
+}
+
+func (b *AMQPBroker) Purge(queueName string) (int, error) {
+	var n int
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		var err error
+		n, err = ch.QueuePurge(queueName, false)
+		return err
+	})
+	return n, topologyError("queue", queueName, err)
+}
+
+func (b *AMQPBroker) Consume(queueName string, prefetch int) (Consumer, error) {
+	conn, err := b.currentConn()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &amqpConsumer{
+		b:        b,
+		queue:    queueName,
+		prefetch: prefetch,
+		tag:      fmt.Sprintf("peril-%d-%d", os.Getpid(), consumerSeq.Add(1)),
+		out:      make(chan Delivery),
+		done:     make(chan struct{}),
+	}
+	deliveryCh, err := c.open(conn)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.consumers[queueName]++
+	b.mu.Unlock()
+
+	go c.run(conn, deliveryCh)
+	return c, nil
+}
+
+var consumerSeq atomic.Uint64
+
+var errConsumerCancelled = errors.New("consumer cancelled")
+
+type amqpConsumer struct {
+	b        *AMQPBroker
+	queue    string
+	prefetch int
+	tag      string
+	out      chan Delivery
+	done     chan struct{}
+
+	mu        sync.Mutex
+	ch        *amqp.Channel
+	cancelled bool
+	closed    bool
+}
+
+func (c *amqpConsumer) Deliveries() <-chan Delivery {
+	return c.out
+}
+
+func (c *amqpConsumer) Cancel() error {
+	c.mu.Lock()
+	if c.cancelled {
+		c.mu.Unlock()
+		return nil
+	}
+	c.cancelled = true
+	close(c.done)
+	ch := c.ch
+	c.mu.Unlock()
+
+	if ch == nil || ch.IsClosed() {
+		return nil
+	}
+	return ch.Cancel(c.tag, false)
+}
+
+func (c *amqpConsumer) Close() error {
+	err := c.Cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.b.releaseConsumer(c.queue)
+	if c.ch == nil || c.ch.IsClosed() {
+		return err
+	}
+	return errors.Join(err, c.ch.Close())
+}
+
+func (b *AMQPBroker) releaseConsumer(queueName string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consumers[queueName]--
+	if b.consumers[queueName] > 0 {
+		return
+	}
+	delete(b.consumers, queueName)
+	b.forgetQueueLocked(queueName)
+}
+
+func (c *amqpConsumer) open(conn *amqp.Connection) (<-chan amqp.Delivery, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Qos(c.prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	deliveryCh, err := ch.Consume(c.queue, c.tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelled {
+		ch.Close()
+		return nil, errConsumerCancelled
+	}
+	c.ch = ch
+	return deliveryCh, nil
+}
+
+// run forwards deliveries and restarts the consumer on every new connection.
+// It stops once the consumer is cancelled, the broker is closed, or the channel
+// dies while its connection is still healthy, since a reconnect won't fix that.
+func (c *amqpConsumer) run(conn *amqp.Connection, deliveryCh <-chan amqp.Delivery) {
+	defer close(c.out)
+	for {
+		for msg := range deliveryCh {
+			select {
+			case c.out <- fromAMQPDelivery(msg):
+			case <-c.b.done:
+				return
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if !conn.IsClosed() {
+			return
+		}
+
+		for {
+			var ok bool
+			conn, ok = c.b.waitForConnection(conn, c.done)
+			if !ok {
+				return
+			}
+			var err error
+			deliveryCh, err = c.open(conn)
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+type amqpAcker struct {
+	msg amqp.Delivery
+}
+
+func (a amqpAcker) Ack() error {
+	return a.msg.Ack(false)
+}
+
+func (a amqpAcker) Nack(requeue bool) error {
+	return a.msg.Nack(false, requeue)
+}
+
+func toAMQPPublishing(msg Publishing) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		Headers:       toAMQPTable(msg.Headers),
+		MessageId:     msg.MessageID,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Type:          msg.Type,
+		Timestamp:     msg.Timestamp,
+		Body:          msg.Body,
+	}
+}
+
+func fromAMQPDelivery(msg amqp.Delivery) Delivery {
+	return Delivery{
+		Publishing: Publishing{
+			ContentType:   msg.ContentType,
+			Headers:       fromAMQPTable(msg.Headers),
+			MessageID:     msg.MessageId,
+			CorrelationID: msg.CorrelationId,
+			ReplyTo:       msg.ReplyTo,
+			Type:          msg.Type,
+			Timestamp:     msg.Timestamp,
+			Body:          msg.Body,
+		},
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.RoutingKey,
+		Redelivered: msg.Redelivered,
+		acker:       amqpAcker{msg: msg},
+	}
+}
+
+func toAMQPTable(headers map[string]any) amqp.Table {
+	if headers == nil {
+		return nil
+	}
+	table := amqp.Table{}
+	for k, v := range headers {
+		table[k] = toAMQPValue(v)
+	}
+	return table
+}
+
+func toAMQPValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return toAMQPTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = toAMQPValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func fromAMQPTable(table amqp.Table) map[string]any {
+	if table == nil {
+		return nil
+	}
+	headers := map[string]any{}
+	for k, v := range table {
+		headers[k] = fromAMQPValue(v)
+	}
+	return headers
+}
+
+func fromAMQPValue(v any) any {
+	switch v := v.(type) {
+	case amqp.Table:
+		return fromAMQPTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = fromAMQPValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func (b *AMQPBroker) NewConfirmPublisher(mandatory bool, timeout time.Duration) BatchPublisher {
+	return &amqpConfirmPublisher{b: b, mandatory: mandatory, timeout: timeout}
+}
+
+// NewDelayedExchangeScheduler schedules through the
+// rabbitmq_delayed_message_exchange plugin, which must be enabled: declaring
+// its exchange type without it closes the connection. Each target exchange
+// gets an x-delayed-message exchange bound in front of it, and the message
+// waits there for its x-delay header. The plugin never reports unroutable
+// messages, so pub should not be a mandatory publisher.
+func (b *AMQPBroker) NewDelayedExchangeScheduler(pub Publisher) Scheduler {
+	return &amqpDelayedScheduler{b: b, pub: pub, declared: map[string]bool{}}
+}
+
+type amqpDelayedScheduler struct {
+	b   *AMQPBroker
+	pub Publisher
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+func (s *amqpDelayedScheduler) Schedule(ctx context.Context, exchange, key string, msg Publishing, delay time.Duration) error {
+	if delay.Milliseconds() <= 0 {
+		return publishMessage(ctx, s.pub, exchange, key, msg)
+	}
+	name, err := s.declare(exchange)
+	if err != nil {
+		return err
+	}
+	msg.Headers = maps.Clone(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	msg.Headers[HeaderDelay] = delay.Milliseconds()
+	return publishMessage(ctx, s.pub, name, key, msg)
+}
+
+// The delayed exchange and its binding are durable, so unlike the rest of
+// the topology they are not replayed after a reconnect.
+func (s *amqpDelayedScheduler) declare(exchange string) (string, error) {
+	name := delayPrefix + "." + exchange
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.declared[name] {
+		return name, nil
+	}
+	err := s.b.withChannel(func(ch *amqp.Channel) error {
+		err := ch.ExchangeDeclare(name, "x-delayed-message", true, false, false, false, amqp.Table{"x-delayed-type": ExchangeFanout})
+		if err != nil {
+			return err
+		}
+		return ch.ExchangeBind(exchange, "", name, false, nil)
+	})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't declare delayed exchange: %w", topologyError("exchange", name, err))
+	}
+	s.declared[name] = true
+	return name, nil
+}
+
+// amqpConfirmPublisher owns a channel in confirm mode and publishes one message
+// at a time so that any basic.return can be matched to the message that caused
+// it. RabbitMQ always sends the return before the ack for the same message.
+type amqpConfirmPublisher struct {
+	b         *AMQPBroker
+	mandatory bool
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+func (p *amqpConfirmPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, err := p.channel()
+	if err != nil {
+		return err
+	}
+	p.drainReturns()
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, p.mandatory, false, toAMQPPublishing(msg))
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ret := <-p.returns:
+		return &ReturnError{
+			Exchange:   ret.Exchange,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  int(ret.ReplyCode),
+			ReplyText:  ret.ReplyText,
+		}
+	default:
+	}
+	if !acked {
+		return ErrNacked
+	}
+	return nil
+}
+
+// PublishBatch matches returns to messages by message ID, so every message
+// in a mandatory batch needs one.
+func (p *amqpConfirmPublisher) PublishBatch(ctx context.Context, msgs []BatchMessage) []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	errs := make([]error, len(msgs))
+	ch, err := p.channel()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	p.drainReturns()
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	// The return buffer is smaller than a batch can be, so collect returns
+	// while waiting rather than letting them back up into the connection.
+	stop := make(chan struct{})
+	collected := make(chan []amqp.Return, 1)
+	go func() {
+		var returns []amqp.Return
+		for {
+			select {
+			case ret, ok := <-p.returns:
+				if !ok {
+					collected <- returns
+					return
+				}
+				returns = append(returns, ret)
+			case <-stop:
+				for {
+					select {
+					case ret, ok := <-p.returns:
+						if ok {
+							returns = append(returns, ret)
+							continue
+						}
+					default:
+					}
+					collected <- returns
+					return
+				}
+			}
+		}
+	}()
+
+	confirms := make([]*amqp.DeferredConfirmation, len(msgs))
+	for i, m := range msgs {
+		confirms[i], errs[i] = ch.PublishWithDeferredConfirmWithContext(ctx, m.Exchange, m.Key, p.mandatory, false, toAMQPPublishing(m.Msg))
+	}
+	for i, confirm := range confirms {
+		if confirm == nil {
+			continue
+		}
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			errs[i] = err
+		} else if !acked {
+			errs[i] = ErrNacked
+		}
+	}
+
+	close(stop)
+	for _, ret := range <-collected {
+		for i, m := range msgs {
+			if errs[i] == nil && m.Msg.MessageID == ret.MessageId {
+				errs[i] = &ReturnError{
+					Exchange:   ret.Exchange,
+					RoutingKey: ret.RoutingKey,
+					ReplyCode:  int(ret.ReplyCode),
+					ReplyText:  ret.ReplyText,
+				}
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func (p *amqpConfirmPublisher) channel() (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	conn, err := p.b.currentConn()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	p.ch = ch
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 16))
+	return ch, nil
+}
+
+func (p *amqpConfirmPublisher) drainReturns() {
+	for {
+		select {
+		case <-p.returns:
+		default:
+			return
+		}
+	}
+}
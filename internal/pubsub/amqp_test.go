@@ -0,0 +1,38 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLastConsumerForgetsQueue(t *testing.T) {
+	b := &AMQPBroker{
+		queues: map[string]QueueSpec{
+			"war":       {Name: "war", Durable: true},
+			"pause.bob": {Name: "pause.bob", Exclusive: true, AutoDelete: true},
+		},
+		queueList: []string{"war", "pause.bob"},
+		bindings: []amqpBinding{
+			{queue: "war", key: "war.*", exchange: "peril_topic"},
+			{queue: "pause.bob", key: "pause", exchange: "peril_direct"},
+		},
+		consumers: map[string]int{"war": 1, "pause.bob": 2},
+	}
+
+	b.releaseConsumer("pause.bob")
+	if _, ok := b.queues["pause.bob"]; !ok {
+		t.Fatal("queue forgotten while another consumer is still open")
+	}
+	b.releaseConsumer("pause.bob")
+	if _, ok := b.queues["pause.bob"]; ok || slices.Contains(b.queueList, "pause.bob") {
+		t.Errorf("closed queue still redeclared: %v", b.queueList)
+	}
+	for _, bind := range b.bindings {
+		if bind.queue == "pause.bob" {
+			t.Errorf("closed queue still rebound: %+v", bind)
+		}
+	}
+	if _, ok := b.queues["war"]; !ok || len(b.bindings) != 1 {
+		t.Errorf("other queue forgotten too: %v %v", b.queueList, b.bindings)
+	}
+}
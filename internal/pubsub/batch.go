@@ -0,0 +1,192 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// PublishResult is the outcome of one message added to a Batch.
+type PublishResult struct {
+	done chan struct{}
+	err  error
+}
+
+func (r *PublishResult) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err is only meaningful once Done is closed.
+func (r *PublishResult) Err() error {
+	return r.err
+}
+
+func (r *PublishResult) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type batchItem struct {
+	msg    BatchMessage
+	result *PublishResult
+}
+
+// Batch accumulates messages and publishes them together once it holds
+// maxCount messages or maxBytes of bodies, or interval after the first one
+// was added. Given a BatchPublisher the whole batch shares one round of
+// confirms; any other Publisher gets the messages one at a time.
+type Batch struct {
+	pub      Publisher
+	maxCount int
+	maxBytes int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []batchItem
+	bytes   int
+	timer   *time.Timer
+	closed  bool
+	// flushQueued is set while a flush started by a full batch has yet to
+	// take the pending messages, so adds past the limit don't start more.
+	flushQueued bool
+
+	flushMu sync.Mutex
+}
+
+type BatchOption func(*Batch)
+
+func WithBatchCount(n int) BatchOption {
+	return func(b *Batch) {
+		b.maxCount = n
+	}
+}
+
+func WithBatchBytes(n int) BatchOption {
+	return func(b *Batch) {
+		b.maxBytes = n
+	}
+}
+
+func WithBatchInterval(d time.Duration) BatchOption {
+	return func(b *Batch) {
+		b.interval = d
+	}
+}
+
+func NewBatch(pub Publisher, opts ...BatchOption) *Batch {
+	b := &Batch{
+		pub:      pub,
+		maxCount: 100,
+		maxBytes: 1 << 20,
+		interval: 50 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// AddToBatch encodes val and queues it on b. ctx only carries trace context;
+// the publish itself happens when the batch flushes.
+func AddToBatch[T any](ctx context.Context, b *Batch, codec Codec, exchange, key string, val T, opts ...PublishOption) *PublishResult {
+	result := &PublishResult{done: make(chan struct{})}
+	msg, err := encode(codec, val, opts)
+	if err != nil {
+		result.err = err
+		close(result.done)
+		return result
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Headers))
+	b.add(batchItem{msg: BatchMessage{Exchange: exchange, Key: key, Msg: msg}, result: result})
+	return result
+}
+
+func (b *Batch) add(item batchItem) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		item.result.err = errors.New("batch is closed")
+		close(item.result.done)
+		return
+	}
+	b.pending = append(b.pending, item)
+	b.bytes += len(item.msg.Msg.Body)
+	full := len(b.pending) >= b.maxCount || b.bytes >= b.maxBytes
+	if !full && b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, func() { b.Flush(context.Background()) })
+	}
+	flush := full && !b.flushQueued
+	if flush {
+		b.flushQueued = true
+	}
+	b.mu.Unlock()
+
+	if flush {
+		go b.Flush(context.Background())
+	}
+}
+
+// Flush publishes everything queued so far and returns once the broker has
+// confirmed it, joining the errors of any messages that failed.
+func (b *Batch) Flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	items := b.pending
+	b.pending = nil
+	b.bytes = 0
+	b.flushQueued = false
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+	if len(items) == 0 {
+		return nil
+	}
+
+	msgs := make([]BatchMessage, len(items))
+	for i, item := range items {
+		msgs[i] = item.msg
+	}
+
+	var errs []error
+	if bp, ok := b.pub.(BatchPublisher); ok {
+		errs = bp.PublishBatch(ctx, msgs)
+	} else {
+		errs = make([]error, len(msgs))
+		for i, m := range msgs {
+			errs[i] = b.pub.Publish(ctx, m.Exchange, m.Key, m.Msg)
+		}
+	}
+
+	var failed []error
+	for i, item := range items {
+		err := errs[i]
+		publishedTotal.WithLabelValues(item.msg.Exchange, item.msg.Key, publishResult(err)).Inc()
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrPublishFailed, err)
+			failed = append(failed, err)
+		}
+		item.result.err = err
+		close(item.result.done)
+	}
+	return errors.Join(failed...)
+}
+
+// Close flushes what is left and refuses further messages.
+func (b *Batch) Close(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return b.Flush(ctx)
+}
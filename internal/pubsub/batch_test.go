@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher records the size of every batch and holds each one until
+// release is closed, if it is set.
+type recordingPublisher struct {
+	pub     BatchPublisher
+	release chan struct{}
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	return p.pub.Publish(ctx, exchange, key, msg)
+}
+
+func (p *recordingPublisher) PublishBatch(ctx context.Context, msgs []BatchMessage) []error {
+	p.mu.Lock()
+	p.sizes = append(p.sizes, len(msgs))
+	p.mu.Unlock()
+	if p.release != nil {
+		<-p.release
+	}
+	return p.pub.PublishBatch(ctx, msgs)
+}
+
+func (p *recordingPublisher) batchSizes() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.sizes...)
+}
+
+func newBatchBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+	return b
+}
+
+func waitResult(t *testing.T, r *PublishResult) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := r.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("batch never flushed")
+	}
+	return err
+}
+
+func TestBatchFlushesAtCount(t *testing.T) {
+	b := newBatchBroker(t)
+	pub := &recordingPublisher{pub: b.NewConfirmPublisher(true, time.Second)}
+	batch := NewBatch(pub, WithBatchCount(3), WithBatchInterval(time.Hour))
+
+	var results []*PublishResult
+	for i := range 3 {
+		results = append(results, AddToBatch(context.Background(), batch, JSON, "direct", "k", i))
+	}
+	for _, r := range results {
+		mustNoErr(t, waitResult(t, r))
+	}
+	if sizes := pub.batchSizes(); len(sizes) != 1 || sizes[0] != 3 {
+		t.Errorf("batch sizes %v, want one batch of 3", sizes)
+	}
+}
+
+func TestBatchFlushesAtBytes(t *testing.T) {
+	b := newBatchBroker(t)
+	pub := &recordingPublisher{pub: b.NewConfirmPublisher(true, time.Second)}
+	batch := NewBatch(pub, WithBatchBytes(16), WithBatchInterval(time.Hour))
+
+	first := AddToBatch(context.Background(), batch, JSON, "direct", "k", "short")
+	select {
+	case <-first.Done():
+		t.Fatal("flushed before reaching the byte limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	second := AddToBatch(context.Background(), batch, JSON, "direct", "k", "long enough to fill it")
+	mustNoErr(t, waitResult(t, first))
+	mustNoErr(t, waitResult(t, second))
+	if sizes := pub.batchSizes(); len(sizes) != 1 || sizes[0] != 2 {
+		t.Errorf("batch sizes %v, want one batch of 2", sizes)
+	}
+}
+
+func TestBatchFlushesAfterInterval(t *testing.T) {
+	b := newBatchBroker(t)
+	batch := NewBatch(b.NewConfirmPublisher(true, time.Second), WithBatchInterval(30*time.Millisecond))
+
+	start := time.Now()
+	mustNoErr(t, waitResult(t, AddToBatch(context.Background(), batch, JSON, "direct", "k", "lonely")))
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("flushed after %v, before the interval", elapsed)
+	}
+	waitForGet(t, b, "q")
+}
+
+func TestBatchReportsEachMessage(t *testing.T) {
+	b := newBatchBroker(t)
+	batch := NewBatch(b.NewConfirmPublisher(true, time.Second), WithBatchInterval(time.Hour))
+
+	ok1 := AddToBatch(context.Background(), batch, JSON, "direct", "k", "first")
+	lost := AddToBatch(context.Background(), batch, JSON, "direct", "nobody", "returned")
+	ok2 := AddToBatch(context.Background(), batch, JSON, "direct", "k", "third")
+	err := batch.Flush(context.Background())
+
+	var returned *ReturnError
+	if !errors.As(err, &returned) {
+		t.Errorf("Flush err = %v, want the ReturnError", err)
+	}
+	if err := lost.Err(); !errors.Is(err, ErrPublishFailed) || !errors.As(err, &returned) {
+		t.Errorf("unroutable message err = %v, want a ReturnError", err)
+	}
+	for _, r := range []*PublishResult{ok1, ok2} {
+		if err := r.Err(); err != nil {
+			t.Errorf("routable message failed: %v", err)
+		}
+	}
+	for _, want := range []string{"first", "third"} {
+		var got string
+		mustNoErr(t, JSON.Unmarshal(waitForGet(t, b, "q").Body, &got))
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBatchCloseRejectsAdds(t *testing.T) {
+	b := newBatchBroker(t)
+	batch := NewBatch(b.NewConfirmPublisher(true, time.Second), WithBatchInterval(time.Hour))
+
+	queued := AddToBatch(context.Background(), batch, JSON, "direct", "k", "before")
+	mustNoErr(t, batch.Close(context.Background()))
+	mustNoErr(t, waitResult(t, queued))
+
+	late := AddToBatch(context.Background(), batch, JSON, "direct", "k", "after")
+	if err := waitResult(t, late); err == nil {
+		t.Error("closed batch accepted a message")
+	}
+	waitForGet(t, b, "q")
+	if _, ok, _ := b.Get("q"); ok {
+		t.Error("message added after Close was published")
+	}
+}
+
+func TestBatchFlushesOncePerThreshold(t *testing.T) {
+	b := newBatchBroker(t)
+	pub := &recordingPublisher{pub: b.NewConfirmPublisher(true, time.Second), release: make(chan struct{})}
+	batch := NewBatch(pub, WithBatchCount(2), WithBatchInterval(time.Hour))
+
+	var results []*PublishResult
+	add := func() {
+		results = append(results, AddToBatch(context.Background(), batch, JSON, "direct", "k", "x"))
+	}
+	add()
+	add()
+	for len(pub.batchSizes()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first batch is stuck publishing; everything added meanwhile is over
+	// the limit but should wait for a single flush.
+	goroutines := runtime.NumGoroutine()
+	for range 50 {
+		add()
+	}
+	if extra := runtime.NumGoroutine() - goroutines; extra > 5 {
+		t.Errorf("%d goroutines started by adds to a full batch", extra)
+	}
+
+	close(pub.release)
+	for _, r := range results {
+		mustNoErr(t, waitResult(t, r))
+	}
+	if sizes := pub.batchSizes(); len(sizes) != 2 || sizes[1] != 50 {
+		t.Errorf("batch sizes %v, want [2 50]", sizes)
+	}
+}
@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+type Publishing struct {
+	ContentType   string
+	Headers       map[string]any
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Type          string
+	Timestamp     time.Time
+	Body          []byte
+}
+
+type Delivery struct {
+	Publishing
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+
+	acker Acknowledger
+}
+
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+func (d Delivery) Ack() error {
+	return d.acker.Ack()
+}
+
+func (d Delivery) Nack(requeue bool) error {
+	return d.acker.Nack(requeue)
+}
+
+const (
+	ExchangeDirect = "direct"
+	ExchangeTopic  = "topic"
+	ExchangeFanout = "fanout"
+)
+
+type ExchangeSpec struct {
+	Name    string
+	Kind    string
+	Durable bool
+}
+
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]any
+}
+
+type Queue struct {
+	Name      string
+	Messages  int
+	Consumers int
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, exchange, key string, msg Publishing) error
+}
+
+// Topology declares and inspects exchanges and queues. The Check methods never
+// create anything: they return ErrNotFound when the entity is missing and
+// ErrInequivalent when it exists with different settings.
+type Topology interface {
+	DeclareExchange(spec ExchangeSpec) error
+	DeclareQueue(spec QueueSpec) (Queue, error)
+	BindQueue(queueName, key, exchange string) error
+	CheckExchange(spec ExchangeSpec) error
+	CheckQueue(spec QueueSpec) (Queue, error)
+}
+
+// Forgetter is implemented by brokers that redeclare their topology after a
+// reconnect. ForgetQueue drops a queue and its bindings from that replay once
+// nothing uses the queue any more.
+type Forgetter interface {
+	ForgetQueue(queueName string)
+}
+
+func forgetQueue(t Topology, queueName string) {
+	if f, ok := t.(Forgetter); ok {
+		f.ForgetQueue(queueName)
+	}
+}
+
+type Subscriber interface {
+	Topology
+	Consume(queueName string, prefetch int) (Consumer, error)
+}
+
+// Consumer is a single basic.consume. Cancel stops new deliveries and closes
+// Deliveries once the ones already sent have been flushed; Close releases the
+// consumer, requeueing anything still unacknowledged.
+type Consumer interface {
+	Deliveries() <-chan Delivery
+	Cancel() error
+	Close() error
+}
+
+// Inspector reads queues outside of a consumer. Messages returned by Get stay
+// unacknowledged until the caller acks or nacks them.
+type Inspector interface {
+	Get(queueName string) (Delivery, bool, error)
+	Purge(queueName string) (int, error)
+}
+
+// Confirmer hands out publishers that wait for the broker to confirm each
+// message. A mandatory one fails with a ReturnError when nothing was routed.
+type Confirmer interface {
+	NewConfirmPublisher(mandatory bool, timeout time.Duration) BatchPublisher
+}
+
+type Broker interface {
+	Publisher
+	Subscriber
+	Inspector
+	Confirmer
+}
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func roundTrip[T any](t *testing.T, c Codec, in T) T {
+	t.Helper()
+	data, err := c.Marshal(in)
+	if err != nil {
+		t.Fatalf("%s marshal: %v", c.ContentType(), err)
+	}
+	var out T
+	err = c.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatalf("%s unmarshal: %v", c.ContentType(), err)
+	}
+	return out
+}
+
+func TestMsgPackRoundTripsGameTypes(t *testing.T) {
+	player := gamelogic.Player{
+		Username: "alice",
+		Units: map[int]gamelogic.Unit{
+			1:  {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+			42: {ID: 42, Rank: gamelogic.RankArtillery, Location: "asia"},
+		},
+	}
+	move := gamelogic.ArmyMove{
+		Player:     player,
+		Units:      []gamelogic.Unit{player.Units[42]},
+		ToLocation: "europe",
+	}
+	if got := roundTrip(t, MsgPack, move); !reflect.DeepEqual(got, move) {
+		t.Errorf("ArmyMove: got %+v, want %+v", got, move)
+	}
+
+	war := gamelogic.RecognitionOfWar{Attacker: player, Defender: gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{}}}
+	if got := roundTrip(t, MsgPack, war); !reflect.DeepEqual(got, war) {
+		t.Errorf("RecognitionOfWar: got %+v, want %+v", got, war)
+	}
+
+	log := routing.GameLog{
+		CurrentTime: time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.FixedZone("CET", 3600)),
+		Message:     "alice won a war against bob",
+		Username:    "alice",
+	}
+	got := roundTrip(t, MsgPack, log)
+	if !got.CurrentTime.Equal(log.CurrentTime) || got.Message != log.Message || got.Username != log.Username {
+		t.Errorf("GameLog: got %+v, want %+v", got, log)
+	}
+}
+
+func TestMsgPackMatchesJSONAndGob(t *testing.T) {
+	state := routing.PlayingState{IsPaused: true}
+	for _, c := range []Codec{JSON, Gob, MsgPack} {
+		if got := roundTrip(t, c, state); got != state {
+			t.Errorf("%s: got %+v, want %+v", c.ContentType(), got, state)
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	c, err := CodecFor("application/msgpack; charset=binary")
+	if err != nil || c != MsgPack {
+		t.Fatalf("CodecFor = %v, %v", c, err)
+	}
+	_, err = CodecFor("text/x-unknown")
+	if err == nil {
+		t.Fatal("unknown content type accepted")
+	}
+}
@@ -0,0 +1,31 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+)
+
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  int
+	ReplyText  string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("message to %q with key %q returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+type BatchMessage struct {
+	Exchange string
+	Key      string
+	Msg      Publishing
+}
+
+// BatchPublisher publishes a whole batch before waiting for confirms, so the
+// batch costs one round trip instead of one per message. The returned errors
+// line up with msgs.
+type BatchPublisher interface {
+	Publisher
+	PublishBatch(ctx context.Context, msgs []BatchMessage) []error
+}
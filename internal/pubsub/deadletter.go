@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+)
+
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+type DeadLetter struct {
+	Delivery
+	Deaths []Death
+}
+
+// Origin is where the message was published before it was dead-lettered. The
+// retry headers win over x-death because a retried message re-enters its queue
+// through the default exchange.
+func (d DeadLetter) Origin() (exchange, key string) {
+	if ex, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		key, _ := d.Headers[HeaderOriginalRoutingKey].(string)
+		return ex, key
+	}
+	if len(d.Deaths) > 0 {
+		death := d.Deaths[len(d.Deaths)-1]
+		if len(death.RoutingKeys) > 0 {
+			return death.Exchange, death.RoutingKeys[0]
+		}
+		return death.Exchange, ""
+	}
+	return d.Exchange, d.RoutingKey
+}
+
+func ParseDeaths(headers map[string]any) []Death {
+	entries, _ := headers["x-death"].([]any)
+	deaths := make([]Death, 0, len(entries))
+	for _, e := range entries {
+		entry, ok := e.(map[string]any)
+		if !ok {
+			continue
+		}
+		death := Death{}
+		death.Queue, _ = entry["queue"].(string)
+		death.Reason, _ = entry["reason"].(string)
+		death.Exchange, _ = entry["exchange"].(string)
+		death.Count, _ = argInt(entry, "count")
+		death.Time, _ = entry["time"].(time.Time)
+		keys, _ := entry["routing-keys"].([]any)
+		for _, k := range keys {
+			if key, ok := k.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, key)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// DeadLetterQueue browses a dead-letter queue. Listed messages are held
+// unacknowledged so they can be replayed by index; listing again or calling
+// Release puts them back.
+type DeadLetterQueue struct {
+	b     Broker
+	pub   Publisher
+	queue string
+	held  []*DeadLetter
+}
+
+// NewDeadLetterQueue replays through pub, which should be a mandatory confirm
+// publisher: a dead letter is only removed once its copy has been confirmed
+// and routed.
+func NewDeadLetterQueue(b Broker, pub Publisher, queue string) *DeadLetterQueue {
+	return &DeadLetterQueue{b: b, pub: pub, queue: queue}
+}
+
+func (q *DeadLetterQueue) List(limit int) ([]DeadLetter, error) {
+	err := q.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	for limit <= 0 || len(q.held) < limit {
+		d, ok, err := q.b.Get(q.queue)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		q.held = append(q.held, &DeadLetter{Delivery: d, Deaths: ParseDeaths(d.Headers)})
+	}
+
+	letters := make([]DeadLetter, len(q.held))
+	for i, d := range q.held {
+		letters[i] = *d
+	}
+	return letters, nil
+}
+
+// Replay republishes the nth message (counting from 1) of the last List to
+// the exchange and routing key it was originally published to. If that fails
+// the dead letter goes back on its queue.
+func (q *DeadLetterQueue) Replay(ctx context.Context, n int) error {
+	if n < 1 || n > len(q.held) || q.held[n-1] == nil {
+		return fmt.Errorf("no dead letter #%d, run list first", n)
+	}
+	d := q.held[n-1]
+
+	exchange, key := d.Origin()
+	pub := d.Publishing
+	pub.Headers = maps.Clone(d.Headers)
+	for k := range pub.Headers {
+		if strings.HasPrefix(k, "x-death") || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			delete(pub.Headers, k)
+		}
+	}
+	delete(pub.Headers, HeaderRetryCount)
+	delete(pub.Headers, HeaderFailureReason)
+	delete(pub.Headers, HeaderOriginalExchange)
+	delete(pub.Headers, HeaderOriginalRoutingKey)
+
+	q.held[n-1] = nil
+	err := q.pub.Publish(ctx, exchange, key, pub)
+	if err != nil {
+		return errors.Join(fmt.Errorf("%w: %w", ErrPublishFailed, err), d.Nack(true))
+	}
+	return d.Ack()
+}
+
+func (q *DeadLetterQueue) ReplayAll(ctx context.Context) (int, error) {
+	letters, err := q.List(0)
+	if err != nil {
+		return 0, err
+	}
+	for i := range letters {
+		err := q.Replay(ctx, i+1)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(letters), nil
+}
+
+func (q *DeadLetterQueue) Purge() (int, error) {
+	err := q.Release()
+	if err != nil {
+		return 0, err
+	}
+	return q.b.Purge(q.queue)
+}
+
+func (q *DeadLetterQueue) Release() error {
+	var errs []error
+	for _, d := range q.held {
+		if d != nil {
+			errs = append(errs, d.Nack(true))
+		}
+	}
+	q.held = nil
+	return errors.Join(errs...)
+}
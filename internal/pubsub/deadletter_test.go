@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func deadLetterOne(t *testing.T, b *MemoryBroker, exchange, key string) {
+	t.Helper()
+	_, err := b.DeclareQueue(QueueSpec{Name: "doomed", Args: map[string]any{"x-dead-letter-exchange": routing.ExchangePerilDLX}})
+	mustNoErr(t, err)
+	mustNoErr(t, b.BindQueue("doomed", key, exchange))
+	mustNoErr(t, b.Publish(context.Background(), exchange, key, Publishing{Body: []byte("x")}))
+	d, ok, err := b.Get("doomed")
+	mustNoErr(t, err)
+	if !ok {
+		t.Fatal("nothing to dead-letter")
+	}
+	mustNoErr(t, d.Nack(false))
+}
+
+func TestReplayRepublishesToOrigin(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	deadLetterOne(t, b, routing.ExchangePerilTopic, "army_moves.alice")
+	declareBound(t, b, "moves", "army_moves.*", routing.ExchangePerilTopic)
+
+	dlq := NewDeadLetterQueue(b, b.NewConfirmPublisher(true, time.Second), routing.QueuePerilDLQ)
+	n, err := dlq.ReplayAll(context.Background())
+	mustNoErr(t, err)
+	if n != 1 {
+		t.Fatalf("replayed %d, want 1", n)
+	}
+	d, ok, err := b.Get("moves")
+	mustNoErr(t, err)
+	if !ok || d.Headers["x-death"] != nil {
+		t.Fatalf("got %+v, %v, want a clean copy", d, ok)
+	}
+	if _, ok, _ := b.Get(routing.QueuePerilDLQ); ok {
+		t.Fatal("replayed dead letter still queued")
+	}
+}
+
+func TestReplayKeepsDeadLetterWhenNotRouted(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "renamed", Kind: ExchangeTopic}))
+	// The origin exchange is gone by the time the dead letter is replayed.
+	deadLetterOne(t, b, "renamed", "army_moves.alice")
+	delete(b.exchanges, "renamed")
+
+	dlq := NewDeadLetterQueue(b, b.NewConfirmPublisher(true, time.Second), routing.QueuePerilDLQ)
+	_, err := dlq.ReplayAll(context.Background())
+	if !errors.Is(err, ErrPublishFailed) {
+		t.Fatalf("err = %v, want ErrPublishFailed", err)
+	}
+	assertStillQueued(t, b, routing.QueuePerilDLQ)
+
+	// The exchange exists again but nothing is bound to the key.
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "renamed", Kind: ExchangeTopic}))
+	_, err = dlq.ReplayAll(context.Background())
+	var returned *ReturnError
+	if !errors.As(err, &returned) {
+		t.Fatalf("err = %v, want a ReturnError", err)
+	}
+	mustNoErr(t, dlq.Release())
+	assertStillQueued(t, b, routing.QueuePerilDLQ)
+}
+
+func assertStillQueued(t *testing.T, b *MemoryBroker, queue string) {
+	t.Helper()
+	d, ok, err := b.Get(queue)
+	mustNoErr(t, err)
+	if !ok {
+		t.Fatal("dead letter was dropped after a failed replay")
+	}
+	mustNoErr(t, d.Nack(true))
+}
@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers which message IDs have already been handled. Swap in a
+// persistent implementation to keep deduplicating across restarts.
+type DedupStore interface {
+	// Reserve claims messageID for one handler. It reports false when the ID
+	// has already been handled or another worker is handling it right now, and
+	// must check and claim in one step so parallel workers can't both win.
+	Reserve(messageID string) (bool, error)
+	// Mark records that a reserved ID has been handled.
+	Mark(messageID string) error
+	// Release gives a reservation up so that a redelivery is handled again.
+	Release(messageID string) error
+}
+
+// Dedup acks messages whose ID the store has already seen without calling the
+// handler. That includes a copy arriving while another worker still holds the
+// first: whatever that handler returns, the first copy is either handled or
+// stays queued. An ID is only marked once the handler has acked the message,
+// so requeued, retried and dead-lettered messages are handled again when they
+// come back, including a DLQ replay that keeps its message ID.
+func Dedup[T any](store DedupStore) Middleware[T] {
+	return func(next MessageHandler[T]) MessageHandler[T] {
+		return func(ctx context.Context, msg Message[T]) AckType {
+			if msg.MessageID == "" {
+				return next(ctx, msg)
+			}
+			fresh, err := store.Reserve(msg.MessageID)
+			if err != nil {
+				fmt.Printf("Error checking for duplicate %s: %v\n", msg.MessageID, err)
+				return next(ctx, msg)
+			}
+			if !fresh {
+				fmt.Printf("Skipping duplicate message %s\n", msg.MessageID)
+				return Ack
+			}
+
+			// The reservation is given up if next panics, so that a Recover
+			// further out doesn't leave the ID claimed forever.
+			ack := NackRequeue
+			defer func() {
+				if ack == Ack {
+					err = store.Mark(msg.MessageID)
+				} else {
+					err = store.Release(msg.MessageID)
+				}
+				if err != nil {
+					fmt.Printf("Error recording %s as handled: %v\n", msg.MessageID, err)
+				}
+			}()
+			ack = next(ctx, msg)
+			return ack
+		}
+	}
+}
+
+// MemoryDedupStore keeps the most recently seen IDs, dropping the least
+// recently seen beyond size and any not seen for ttl. Seeing a duplicate
+// counts as a use. A reservation held for longer than ttl is given up, in case
+// its handler never finished.
+type MemoryDedupStore struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu       sync.Mutex
+	order    *list.List
+	ids      map[string]*list.Element
+	reserved map[string]time.Time
+}
+
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:     size,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		ids:      map[string]*list.Element{},
+		reserved: map[string]time.Time{},
+	}
+}
+
+func (s *MemoryDedupStore) Reserve(messageID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if el, ok := s.ids[messageID]; ok {
+		el.Value = dedupEntry{id: messageID, seen: s.now()}
+		s.order.MoveToFront(el)
+		return false, nil
+	}
+	if _, ok := s.reserved[messageID]; ok {
+		return false, nil
+	}
+	s.reserved[messageID] = s.now()
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, messageID)
+	if el, ok := s.ids[messageID]; ok {
+		s.order.Remove(el)
+	}
+	s.ids[messageID] = s.order.PushFront(dedupEntry{id: messageID, seen: s.now()})
+	for s.size > 0 && s.order.Len() > s.size {
+		s.removeLocked(s.order.Back())
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) Release(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, messageID)
+	return nil
+}
+
+func (s *MemoryDedupStore) expireLocked() {
+	if s.ttl <= 0 {
+		return
+	}
+	cutoff := s.now().Add(-s.ttl)
+	for id, at := range s.reserved {
+		if at.Before(cutoff) {
+			delete(s.reserved, id)
+		}
+	}
+	for el := s.order.Back(); el != nil && el.Value.(dedupEntry).seen.Before(cutoff); el = s.order.Back() {
+		s.removeLocked(el)
+	}
+}
+
+func (s *MemoryDedupStore) removeLocked(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.ids, el.Value.(dedupEntry).id)
+}
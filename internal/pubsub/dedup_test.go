@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupHandlesParallelCopiesOnce(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	var calls atomic.Int32
+	handler := func(ctx context.Context, msg Message[string]) AckType {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return Ack
+	}
+	sub, err := Subscribe(context.Background(), b, "direct", "war", "war", QueueDurable,
+		Chain(handler, Dedup[string](NewMemoryDedupStore(100, time.Hour))), WithWorkers(4))
+	mustNoErr(t, err)
+
+	for range 4 {
+		mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "war", "alice vs bob", WithMessageID("war-1")))
+	}
+	time.Sleep(100 * time.Millisecond)
+	mustNoErr(t, sub.Close())
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times for one message ID", n)
+	}
+	if _, ok, _ := b.Get("war"); ok {
+		t.Fatal("duplicates were left on the queue")
+	}
+}
+
+func TestDedupReleasesRequeuedMessages(t *testing.T) {
+	store := NewMemoryDedupStore(100, time.Hour)
+	attempts := 0
+	h := Dedup[string](store)(func(ctx context.Context, msg Message[string]) AckType {
+		attempts++
+		if attempts == 1 {
+			return NackRequeue
+		}
+		return Ack
+	})
+	msg := Message[string]{Envelope: Envelope{MessageID: "m"}}
+	for _, want := range []AckType{NackRequeue, Ack, Ack} {
+		if got := h(context.Background(), msg); got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if attempts != 2 {
+		t.Fatalf("handler ran %d times, want the requeued copy and no more", attempts)
+	}
+}
+
+func TestMemoryDedupStoreEvictsLeastRecentlySeen(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryDedupStore(2, time.Minute)
+	store.now = func() time.Time { return now }
+	handle := func(id string) bool {
+		fresh, err := store.Reserve(id)
+		mustNoErr(t, err)
+		if fresh {
+			mustNoErr(t, store.Mark(id))
+		}
+		return fresh
+	}
+
+	handle("a")
+	handle("b")
+	if handle("a") {
+		t.Fatal("a handled twice")
+	}
+	handle("c")
+	if handle("a") {
+		t.Fatal("a was evicted although b was used less recently")
+	}
+	if !handle("b") {
+		t.Fatal("b should have been evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !handle("a") {
+		t.Fatal("a should have expired")
+	}
+}
+
+func TestDedupHandlesReplayedDeadLetters(t *testing.T) {
+	store := NewMemoryDedupStore(100, time.Hour)
+	attempts := 0
+	h := Dedup[string](store)(func(ctx context.Context, msg Message[string]) AckType {
+		attempts++
+		if attempts == 1 {
+			return NackDiscard
+		}
+		return Ack
+	})
+	msg := Message[string]{Envelope: Envelope{MessageID: "m"}}
+	for _, want := range []AckType{NackDiscard, Ack, Ack} {
+		if got := h(context.Background(), msg); got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if attempts != 2 {
+		t.Fatalf("handler ran %d times, want the replayed copy handled once", attempts)
+	}
+}
+
+func TestDedupReleasesAfterPanic(t *testing.T) {
+	store := NewMemoryDedupStore(100, time.Hour)
+	attempts := 0
+	h := Chain(func(ctx context.Context, msg Message[string]) AckType {
+		attempts++
+		if attempts == 1 {
+			panic("handler bug")
+		}
+		return Ack
+	}, Recover[string], Dedup[string](store))
+
+	msg := Message[string]{Envelope: Envelope{MessageID: "m"}}
+	if got := h(context.Background(), msg); got != NackDiscard {
+		t.Fatalf("got %v, want the panic turned into NackDiscard", got)
+	}
+	if got := h(context.Background(), msg); got != Ack || attempts != 2 {
+		t.Fatalf("got %v after %d attempts, want the redelivery handled", got, attempts)
+	}
+}
+
+func TestMemoryDedupStoreExpiresStaleReservations(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryDedupStore(100, time.Minute)
+	store.now = func() time.Time { return now }
+
+	fresh, err := store.Reserve("m")
+	mustNoErr(t, err)
+	if !fresh {
+		t.Fatal("first reservation refused")
+	}
+	now = now.Add(30 * time.Second)
+	if fresh, _ := store.Reserve("m"); fresh {
+		t.Fatal("reserved twice while the first holder may still be working")
+	}
+	now = now.Add(time.Minute)
+	if fresh, _ := store.Reserve("m"); !fresh {
+		t.Fatal("abandoned reservation never expired")
+	}
+}
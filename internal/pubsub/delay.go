@@ -0,0 +1,179 @@
+package pubsub
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// Scheduler publishes a message to exchange with key once delay has passed.
+type Scheduler interface {
+	Schedule(ctx context.Context, exchange, key string, msg Publishing, delay time.Duration) error
+}
+
+// PublishDelayed encodes val now and has s deliver it after delay. The
+// envelope, including the timestamp, is set when the message is scheduled.
+func PublishDelayed[T any](ctx context.Context, s Scheduler, codec Codec, exchange, key string, val T, delay time.Duration, opts ...PublishOption) error {
+	msg, err := encode(codec, val, opts)
+	if err != nil {
+		return err
+	}
+	return s.Schedule(ctx, exchange, key, msg, delay)
+}
+
+const delayPrefix = "peril_delay"
+
+// HeaderDelay is read by the delayed message plugin, in milliseconds.
+const HeaderDelay = "x-delay"
+
+// DelayQueueScheduler parks messages in a queue whose TTL is the delay and
+// whose dead-letter exchange is the real target. Each (exchange, delay) pair
+// gets a fanout exchange in front of its queue, so the message keeps its own
+// routing key when it is dead-lettered. Every distinct delay creates a queue,
+// so callers should stick to a handful of round values.
+type DelayQueueScheduler struct {
+	t   Topology
+	pub Publisher
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+// NewDelayQueueScheduler declares delay queues through t and publishes
+// through pub, which may be a confirm publisher.
+func NewDelayQueueScheduler(t Topology, pub Publisher) *DelayQueueScheduler {
+	return &DelayQueueScheduler{
+		t:        t,
+		pub:      pub,
+		declared: map[string]bool{},
+	}
+}
+
+func (s *DelayQueueScheduler) Schedule(ctx context.Context, exchange, key string, msg Publishing, delay time.Duration) error {
+	if delay.Milliseconds() <= 0 {
+		return publishMessage(ctx, s.pub, exchange, key, msg)
+	}
+	name, err := s.declare(exchange, delay)
+	if err != nil {
+		return err
+	}
+	return publishMessage(ctx, s.pub, name, key, msg)
+}
+
+func (s *DelayQueueScheduler) declare(exchange string, delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.%s.%d", delayPrefix, exchange, delay.Milliseconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.declared[name] {
+		return name, nil
+	}
+	err := s.t.DeclareExchange(ExchangeSpec{Name: name, Kind: ExchangeFanout, Durable: true})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't declare delay exchange: %w", err)
+	}
+	_, err = s.t.DeclareQueue(QueueSpec{
+		Name:    name,
+		Durable: true,
+		Args: map[string]any{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": exchange,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't declare delay queue: %w", err)
+	}
+	err = s.t.BindQueue(name, "", name)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't bind delay queue: %w", err)
+	}
+	s.declared[name] = true
+	return name, nil
+}
+
+// FakeScheduler holds scheduled messages until Advance moves its clock past
+// their due time. It is meant for tests that should not wait on real delays.
+type FakeScheduler struct {
+	pub Publisher
+
+	mu      sync.Mutex
+	now     time.Duration
+	seq     int
+	pending []fakeScheduled
+}
+
+type fakeScheduled struct {
+	due      time.Duration
+	seq      int
+	exchange string
+	key      string
+	msg      Publishing
+}
+
+func NewFakeScheduler(pub Publisher) *FakeScheduler {
+	return &FakeScheduler{pub: pub}
+}
+
+// Schedule keeps the caller's trace context in the message headers, so the
+// publish made by Advance joins the trace that scheduled it.
+func (s *FakeScheduler) Schedule(ctx context.Context, exchange, key string, msg Publishing, delay time.Duration) error {
+	msg.Headers = maps.Clone(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Headers))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.pending = append(s.pending, fakeScheduled{
+		due:      s.now + max(delay, 0),
+		seq:      s.seq,
+		exchange: exchange,
+		key:      key,
+		msg:      msg,
+	})
+	return nil
+}
+
+// Advance moves the clock forward by d and publishes everything now due, in
+// due order and then in the order it was scheduled.
+func (s *FakeScheduler) Advance(ctx context.Context, d time.Duration) error {
+	s.mu.Lock()
+	s.now += d
+	var due, rest []fakeScheduled
+	for _, m := range s.pending {
+		if m.due <= s.now {
+			due = append(due, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	s.pending = rest
+	s.mu.Unlock()
+
+	slices.SortFunc(due, func(a, b fakeScheduled) int {
+		return cmp.Or(cmp.Compare(a.due, b.due), cmp.Compare(a.seq, b.seq))
+	})
+	for _, m := range due {
+		pubCtx := otel.GetTextMapPropagator().Extract(ctx, headerCarrier(m.msg.Headers))
+		err := publishMessage(pubCtx, s.pub, m.exchange, m.key, m.msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending reports how many messages are still waiting.
+func (s *FakeScheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDelayQueueSchedulerDeliversToTarget(t *testing.T) {
+	exporter := installTestTracing(t)
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "pause.alice", routing.PauseKey, "direct")
+	declareBound(t, b, "other", "other", "direct")
+
+	delayExchange := "peril_delay.direct.50"
+	published := testutil.ToFloat64(publishedTotal.WithLabelValues(delayExchange, routing.PauseKey, "ok"))
+
+	s := NewDelayQueueScheduler(b, b.NewConfirmPublisher(true, time.Second))
+	start := time.Now()
+	err := PublishDelayed(context.Background(), s, JSON, "direct", routing.PauseKey, routing.PlayingState{IsPaused: false}, 50*time.Millisecond)
+	mustNoErr(t, err)
+	if _, ok, _ := b.Get("pause.alice"); ok {
+		t.Fatal("delivered before the delay")
+	}
+
+	d := waitForGet(t, b, "pause.alice")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delivered after %v", elapsed)
+	}
+	if d.Exchange != "direct" || d.RoutingKey != routing.PauseKey {
+		t.Errorf("arrived via %s/%s, want the target exchange and original key", d.Exchange, d.RoutingKey)
+	}
+	var state routing.PlayingState
+	mustNoErr(t, JSON.Unmarshal(d.Body, &state))
+	if state.IsPaused {
+		t.Errorf("got %+v", state)
+	}
+	if _, ok, _ := b.Get("other"); ok {
+		t.Error("delayed message routed to a queue bound with another key")
+	}
+
+	if got := testutil.ToFloat64(publishedTotal.WithLabelValues(delayExchange, routing.PauseKey, "ok")); got != published+1 {
+		t.Errorf("published_total = %v, want %v", got, published+1)
+	}
+	var producer bool
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "publish "+delayExchange && span.SpanKind == trace.SpanKindProducer {
+			producer = true
+		}
+	}
+	if !producer {
+		t.Error("no producer span for the scheduled publish")
+	}
+}
+
+func TestFakeSchedulerAdvance(t *testing.T) {
+	exporter := installTestTracing(t)
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+	s := NewFakeScheduler(b)
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "pause 5m")
+	mustNoErr(t, PublishDelayed(ctx, s, JSON, "direct", "k", "second", 5*time.Minute))
+	mustNoErr(t, PublishDelayed(ctx, s, JSON, "direct", "k", "first", time.Minute))
+	root.End()
+
+	mustNoErr(t, s.Advance(context.Background(), 59*time.Second))
+	if s.Pending() != 2 {
+		t.Fatalf("%d pending after 59s, want 2", s.Pending())
+	}
+	mustNoErr(t, s.Advance(context.Background(), 5*time.Minute))
+	if s.Pending() != 0 {
+		t.Fatalf("%d pending, want 0", s.Pending())
+	}
+
+	for _, want := range []string{"first", "second"} {
+		d, ok, err := b.Get("q")
+		mustNoErr(t, err)
+		var got string
+		if ok {
+			mustNoErr(t, JSON.Unmarshal(d.Body, &got))
+		}
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	var published int
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "publish direct" {
+			published++
+			if span.Parent.SpanID() != root.SpanContext().SpanID() {
+				t.Errorf("scheduled publish not parented by the span that scheduled it")
+			}
+		}
+	}
+	if published != 2 {
+		t.Errorf("%d publish spans, want 2", published)
+	}
+}
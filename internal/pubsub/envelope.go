@@ -0,0 +1,193 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderSender        = "x-sender"
+)
+
+// Envelope is the metadata every pubsub publisher attaches to a message. It
+// travels in the AMQP properties and headers, never in the body.
+type Envelope struct {
+	Type          string
+	Version       int
+	MessageID     string
+	Sender        string
+	Timestamp     time.Time
+	CorrelationID string
+	ReplyTo       string
+}
+
+func EnvelopeOf(d Delivery) Envelope {
+	version, _ := argInt(d.Headers, HeaderSchemaVersion)
+	sender, _ := d.Headers[HeaderSender].(string)
+	return Envelope{
+		Type:          d.Type,
+		Version:       int(version),
+		MessageID:     d.MessageID,
+		Sender:        sender,
+		Timestamp:     d.Timestamp,
+		CorrelationID: d.CorrelationID,
+		ReplyTo:       d.ReplyTo,
+	}
+}
+
+func (e Envelope) apply(msg *Publishing) {
+	msg.Type = e.Type
+	msg.MessageID = e.MessageID
+	msg.CorrelationID = e.CorrelationID
+	msg.ReplyTo = e.ReplyTo
+	msg.Timestamp = e.Timestamp
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	msg.Headers[HeaderSchemaVersion] = int64(e.Version)
+	if e.Sender != "" {
+		msg.Headers[HeaderSender] = e.Sender
+	}
+}
+
+type PublishOption func(*Envelope)
+
+func WithSender(sender string) PublishOption {
+	return func(e *Envelope) {
+		e.Sender = sender
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(e *Envelope) {
+		e.CorrelationID = id
+	}
+}
+
+func WithReplyTo(queue string) PublishOption {
+	return func(e *Envelope) {
+		e.ReplyTo = queue
+	}
+}
+
+func WithMessageID(id string) PublishOption {
+	return func(e *Envelope) {
+		e.MessageID = id
+	}
+}
+
+func newEnvelope[T any](opts []PublishOption) Envelope {
+	s := schemaFor(reflect.TypeFor[T]())
+	e := Envelope{
+		Type:      s.name,
+		Version:   s.version,
+		MessageID: NewMessageID(),
+		Timestamp: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	return e
+}
+
+func NewMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type schema struct {
+	name      string
+	version   int
+	upcasters map[int]func(Codec, []byte) (any, error)
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[reflect.Type]*schema{}
+)
+
+// RegisterSchema names T on the wire and sets the version publishers stamp on
+// it. Types that are never registered go out as their Go type name at
+// version 1.
+func RegisterSchema[T any](name string, version int) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	s := schemaEntry(reflect.TypeFor[T]())
+	s.name = name
+	s.version = version
+}
+
+// RegisterUpcaster converts payloads published at an older schema version of
+// T. The body is decoded into Old with the message's codec and fn turns it
+// into the current T before the handler sees it.
+func RegisterUpcaster[Old, T any](version int, fn func(Old) T) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	s := schemaEntry(reflect.TypeFor[T]())
+	s.upcasters[version] = func(codec Codec, data []byte) (any, error) {
+		var old Old
+		err := codec.Unmarshal(data, &old)
+		if err != nil {
+			return nil, err
+		}
+		return fn(old), nil
+	}
+}
+
+func schemaEntry(t reflect.Type) *schema {
+	s, ok := schemas[t]
+	if !ok {
+		s = &schema{
+			name:      t.String(),
+			version:   1,
+			upcasters: map[int]func(Codec, []byte) (any, error){},
+		}
+		schemas[t] = s
+	}
+	return s
+}
+
+func schemaFor(t reflect.Type) schema {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	if s, ok := schemas[t]; ok {
+		return *s
+	}
+	return schema{name: t.String(), version: 1}
+}
+
+func upcasterFor(t reflect.Type, version int) (func(Codec, []byte) (any, error), bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	s, ok := schemas[t]
+	if !ok || version == s.version {
+		return nil, false
+	}
+	fn, ok := s.upcasters[version]
+	return fn, ok
+}
+
+func upcast[T any](msg Delivery, codec Codec) (T, bool, error) {
+	var target T
+	// Publishers from before schema versions existed sent no header, and
+	// their payloads are version 1.
+	version, ok := argInt(msg.Headers, HeaderSchemaVersion)
+	if !ok {
+		version = 1
+	}
+	fn, ok := upcasterFor(reflect.TypeFor[T](), int(version))
+	if !ok {
+		return target, false, nil
+	}
+	v, err := fn(codec, msg.Body)
+	if err != nil {
+		return target, true, fmt.Errorf("upcasting %s v%d: %w", msg.Type, version, err)
+	}
+	return v.(T), true, nil
+}
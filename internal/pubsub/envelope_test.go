@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+)
+
+type moveV1 struct{ To string }
+
+type moveV2 struct{ Destination string }
+
+type moveV3 struct {
+	Destination string
+	Turn        int
+}
+
+func init() {
+	RegisterSchema[moveV3]("test.move", 3)
+	RegisterUpcaster(1, func(old moveV1) moveV3 { return moveV3{Destination: old.To} })
+	RegisterUpcaster(2, func(old moveV2) moveV3 { return moveV3{Destination: old.Destination} })
+}
+
+func TestRegisterSchemaStampsPublishes(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "moves", "k", "direct")
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", moveV3{Destination: "asia"}, WithSender("alice")))
+	env := EnvelopeOf(waitForGet(t, b, "moves"))
+	if env.Type != "test.move" || env.Version != 3 || env.Sender != "alice" || env.MessageID == "" {
+		t.Errorf("envelope = %+v", env)
+	}
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", moveV1{To: "asia"}))
+	env = EnvelopeOf(waitForGet(t, b, "moves"))
+	if env.Type != "pubsub.moveV1" || env.Version != 1 {
+		t.Errorf("unregistered type went out as %s v%d, want its Go name at v1", env.Type, env.Version)
+	}
+}
+
+func TestUpcastOlderVersions(t *testing.T) {
+	v1, err := JSON.Marshal(moveV1{To: "europe"})
+	mustNoErr(t, err)
+	v2, err := JSON.Marshal(moveV2{Destination: "africa"})
+	mustNoErr(t, err)
+	v3, err := JSON.Marshal(moveV3{Destination: "asia", Turn: 4})
+	mustNoErr(t, err)
+
+	cases := []struct {
+		name    string
+		headers map[string]any
+		body    []byte
+		want    moveV3
+	}{
+		{"v1", map[string]any{HeaderSchemaVersion: int64(1)}, v1, moveV3{Destination: "europe"}},
+		{"v2", map[string]any{HeaderSchemaVersion: int32(2)}, v2, moveV3{Destination: "africa"}},
+		{"current", map[string]any{HeaderSchemaVersion: int64(3)}, v3, moveV3{Destination: "asia", Turn: 4}},
+		{"no header", nil, v1, moveV3{Destination: "europe"}},
+	}
+	for _, c := range cases {
+		msg := Delivery{Publishing: Publishing{ContentType: JSON.ContentType(), Headers: c.headers, Body: c.body}}
+		got, err := decode[moveV3](msg, JSON)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
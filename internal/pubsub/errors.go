@@ -0,0 +1,16 @@
+package pubsub
+
+import "errors"
+
+var (
+	ErrUnknownQueueType   = errors.New("unknown queue type")
+	ErrUnknownAckType     = errors.New("unknown ack type")
+	ErrUnknownContentType = errors.New("unknown content type")
+	ErrPublishFailed      = errors.New("publish failed")
+	ErrNotConnected       = errors.New("not connected to broker")
+	ErrNacked             = errors.New("message nacked by broker")
+	ErrSubscriptionClosed = errors.New("subscription closed by broker")
+	ErrNotFound           = errors.New("not found")
+	ErrInequivalent       = errors.New("declared with different settings")
+	ErrClientClosed       = errors.New("rpc client closed")
+)
@@ -0,0 +1,622 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It routes through
+// direct, topic and fanout exchanges, honours prefetch, acks and requeues,
+// and dead-letters rejected messages the same way the real broker does.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	consumers map[*memConsumer]struct{}
+	nextID    int
+	closed    bool
+}
+
+type memExchange struct {
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	spec        QueueSpec
+	messages    []*memMessage
+	consumers   int
+	hadConsumer bool
+	deleted     bool
+	cond        *sync.Cond
+	getter      *memConsumer
+}
+
+type memMessage struct {
+	pub         Publishing
+	exchange    string
+	key         string
+	redelivered bool
+	expiresAt   time.Time
+}
+
+type memConsumer struct {
+	b         *MemoryBroker
+	queue     *memQueue
+	prefetch  int
+	unacked   map[*memMessage]struct{}
+	out       chan Delivery
+	done      chan struct{}
+	cancelled bool
+	closed    bool
+}
+
+type memAcker struct {
+	b   *MemoryBroker
+	c   *memConsumer
+	msg *memMessage
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		consumers: map[*memConsumer]struct{}{},
+	}
+	b.exchanges[""] = &memExchange{kind: ExchangeDirect, durable: true}
+	return b
+}
+
+func (b *MemoryBroker) DeclareExchange(spec ExchangeSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch spec.Kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+	default:
+		return fmt.Errorf("unsupported exchange type %q", spec.Kind)
+	}
+	if ex, ok := b.exchanges[spec.Name]; ok {
+		if ex.kind != spec.Kind || ex.durable != spec.Durable {
+			return fmt.Errorf("exchange %q: %w", spec.Name, ErrInequivalent)
+		}
+		return nil
+	}
+	b.exchanges[spec.Name] = &memExchange{kind: spec.Kind, durable: spec.Durable}
+	return nil
+}
+
+func (b *MemoryBroker) CheckExchange(spec ExchangeSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[spec.Name]
+	if !ok {
+		return fmt.Errorf("exchange %q: %w", spec.Name, ErrNotFound)
+	}
+	if ex.kind != spec.Kind || ex.durable != spec.Durable {
+		return fmt.Errorf("exchange %q: %w", spec.Name, ErrInequivalent)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) CheckQueue(spec QueueSpec) (Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[spec.Name]
+	if !ok {
+		return Queue{}, fmt.Errorf("queue %q: %w", spec.Name, ErrNotFound)
+	}
+	if !equivalentQueues(q.spec, spec) {
+		return q.info(), fmt.Errorf("queue %q: %w", spec.Name, ErrInequivalent)
+	}
+	return q.info(), nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for c := range b.consumers {
+		b.closeConsumer(c)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errors.New("broker is closed")
+	}
+	_, err := b.route(exchange, key, msg)
+	return err
+}
+
+func (b *MemoryBroker) DeclareQueue(spec QueueSpec) (Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if spec.Name == "" {
+		b.nextID++
+		spec.Name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+
+	if q, ok := b.queues[spec.Name]; ok {
+		if !equivalentQueues(q.spec, spec) {
+			return Queue{}, fmt.Errorf("queue %q: %w", spec.Name, ErrInequivalent)
+		}
+		return q.info(), nil
+	}
+
+	q := &memQueue{spec: spec, cond: sync.NewCond(&b.mu)}
+	b.queues[spec.Name] = q
+	return q.info(), nil
+}
+
+func (b *MemoryBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if exchange == "" {
+		return errors.New("cannot bind to the default exchange")
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q not found", exchange)
+	}
+	if _, ok := b.queues[queueName]; !ok {
+		return fmt.Errorf("queue %q not found", queueName)
+	}
+	for _, bind := range ex.bindings {
+		if bind.queue == queueName && bind.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: queueName, key: key})
+	return nil
+}
+
+func (b *MemoryBroker) Consume(queueName string, prefetch int) (Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil, fmt.Errorf("queue %q not found", queueName)
+	}
+
+	c := &memConsumer{
+		b:        b,
+		queue:    q,
+		prefetch: prefetch,
+		unacked:  map[*memMessage]struct{}{},
+		out:      make(chan Delivery),
+		done:     make(chan struct{}),
+	}
+	q.consumers++
+	q.hadConsumer = true
+	b.consumers[c] = struct{}{}
+
+	go b.deliver(c)
+	return c, nil
+}
+
+func (c *memConsumer) Deliveries() <-chan Delivery {
+	return c.out
+}
+
+func (c *memConsumer) Cancel() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.b.cancelConsumer(c)
+	return nil
+}
+
+func (c *memConsumer) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.b.closeConsumer(c)
+	return nil
+}
+
+func (b *MemoryBroker) Get(queueName string) (Delivery, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return Delivery{}, false, fmt.Errorf("queue %q: %w", queueName, ErrNotFound)
+	}
+	if len(q.messages) == 0 {
+		return Delivery{}, false, nil
+	}
+	if q.getter == nil {
+		q.getter = &memConsumer{b: b, queue: q, unacked: map[*memMessage]struct{}{}}
+	}
+
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	q.getter.unacked[msg] = struct{}{}
+	return msg.delivery(b, q.getter), true, nil
+}
+
+func (b *MemoryBroker) Purge(queueName string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return 0, fmt.Errorf("queue %q: %w", queueName, ErrNotFound)
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+func (b *MemoryBroker) deliver(c *memConsumer) {
+	defer close(c.out)
+	q := c.queue
+	for {
+		b.mu.Lock()
+		for !c.cancelled && (len(q.messages) == 0 || (c.prefetch > 0 && len(c.unacked) >= c.prefetch)) {
+			q.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		c.unacked[msg] = struct{}{}
+		d := msg.delivery(b, c)
+		b.mu.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if _, ok := c.unacked[msg]; ok {
+				delete(c.unacked, msg)
+				q.messages = append([]*memMessage{msg}, q.messages...)
+				q.cond.Broadcast()
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// cancelConsumer must be called with b.mu held. Like basic.cancel it stops new
+// deliveries but leaves outstanding ones open for acknowledgement.
+func (b *MemoryBroker) cancelConsumer(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+
+	q := c.queue
+	q.consumers--
+	if q.consumers == 0 && q.spec.AutoDelete {
+		b.deleteQueue(q)
+	}
+	q.cond.Broadcast()
+}
+
+// closeConsumer must be called with b.mu held. Unacknowledged messages go back
+// to the head of the queue, as they would when an AMQP channel closes.
+func (b *MemoryBroker) closeConsumer(c *memConsumer) {
+	b.cancelConsumer(c)
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(b.consumers, c)
+
+	q := c.queue
+	requeued := make([]*memMessage, 0, len(c.unacked))
+	for msg := range c.unacked {
+		msg.redelivered = true
+		requeued = append(requeued, msg)
+	}
+	c.unacked = map[*memMessage]struct{}{}
+	if !q.deleted {
+		q.messages = append(requeued, q.messages...)
+	}
+	q.cond.Broadcast()
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	q.deleted = true
+	q.messages = nil
+	delete(b.queues, q.spec.Name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bind := range ex.bindings {
+			if bind.queue != q.spec.Name {
+				kept = append(kept, bind)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+// route must be called with b.mu held. It reports how many queues received
+// the message.
+func (b *MemoryBroker) route(exchange, key string, msg Publishing) (int, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return 0, fmt.Errorf("exchange %q not found", exchange)
+	}
+
+	var targets []*memQueue
+	seen := map[string]bool{}
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	}
+	for _, bind := range ex.bindings {
+		if seen[bind.queue] || !bindingMatches(ex.kind, bind.key, key) {
+			continue
+		}
+		seen[bind.queue] = true
+		targets = append(targets, b.queues[bind.queue])
+	}
+
+	for _, q := range targets {
+		b.enqueue(q, &memMessage{
+			pub:      copyPublishing(msg),
+			exchange: exchange,
+			key:      key,
+		})
+	}
+	return len(targets), nil
+}
+
+func (b *MemoryBroker) enqueue(q *memQueue, msg *memMessage) {
+	q.messages = append(q.messages, msg)
+	if ttl, ok := argInt(q.spec.Args, "x-message-ttl"); ok {
+		d := time.Duration(ttl) * time.Millisecond
+		msg.expiresAt = time.Now().Add(d)
+		time.AfterFunc(d, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(q)
+		})
+	}
+	q.cond.Broadcast()
+}
+
+// expire dead-letters expired messages from the head of the queue. Like
+// RabbitMQ it never looks past a message that is still live.
+func (b *MemoryBroker) expire(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 && !q.deleted {
+		msg := q.messages[0]
+		if msg.expiresAt.IsZero() || msg.expiresAt.After(now) {
+			return
+		}
+		q.messages = q.messages[1:]
+		b.deadLetter(q, msg, "expired")
+	}
+}
+
+func (b *MemoryBroker) deadLetter(q *memQueue, msg *memMessage, reason string) {
+	dlx, ok := q.spec.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := msg.key
+	if dlk, ok := q.spec.Args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	pub := copyPublishing(msg.pub)
+	recordDeath(pub.Headers, q.spec.Name, reason, msg.exchange, msg.key)
+	b.route(dlx, key, pub)
+}
+
+func (a *memAcker) Ack() error {
+	return a.settle(func() {})
+}
+
+func (a *memAcker) Nack(requeue bool) error {
+	return a.settle(func() {
+		q := a.c.queue
+		if q.deleted {
+			return
+		}
+		if requeue {
+			a.msg.redelivered = true
+			q.messages = append([]*memMessage{a.msg}, q.messages...)
+			return
+		}
+		a.b.deadLetter(q, a.msg, "rejected")
+	})
+}
+
+func (a *memAcker) settle(fn func()) error {
+	a.b.mu.Lock()
+	defer a.b.mu.Unlock()
+
+	if a.c.closed {
+		return errors.New("consumer is closed")
+	}
+	if _, ok := a.c.unacked[a.msg]; !ok {
+		return errors.New("unknown delivery tag")
+	}
+	delete(a.c.unacked, a.msg)
+	fn()
+	a.c.queue.cond.Broadcast()
+	return nil
+}
+
+func (m *memMessage) delivery(b *MemoryBroker, c *memConsumer) Delivery {
+	return Delivery{
+		Publishing:  m.pub,
+		Exchange:    m.exchange,
+		RoutingKey:  m.key,
+		Redelivered: m.redelivered,
+		acker:       &memAcker{b: b, c: c, msg: m},
+	}
+}
+
+func (q *memQueue) info() Queue {
+	return Queue{Name: q.spec.Name, Messages: len(q.messages), Consumers: q.consumers}
+}
+
+func equivalentQueues(a, b QueueSpec) bool {
+	if a.Durable != b.Durable || a.AutoDelete != b.AutoDelete || a.Exclusive != b.Exclusive {
+		return false
+	}
+	return reflect.DeepEqual(normalizeArgs(a.Args), normalizeArgs(b.Args))
+}
+
+func normalizeArgs(args map[string]any) map[string]any {
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeTopic:
+		return topicMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+func topicMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if topicMatch(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && topicMatch(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && topicMatch(pattern[1:], key[1:])
+	}
+}
+
+func copyPublishing(msg Publishing) Publishing {
+	msg.Headers = maps.Clone(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	msg.Body = append([]byte(nil), msg.Body...)
+	return msg
+}
+
+func recordDeath(headers map[string]any, queue, reason, exchange, key string) {
+	deaths, _ := headers["x-death"].([]any)
+	count := int64(1)
+	kept := make([]any, 0, len(deaths)+1)
+	for _, d := range deaths {
+		entry, ok := d.(map[string]any)
+		if ok && entry["queue"] == queue && entry["reason"] == reason {
+			if n, ok := entry["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		kept = append(kept, d)
+	}
+	entry := map[string]any{
+		"queue":        queue,
+		"reason":       reason,
+		"exchange":     exchange,
+		"routing-keys": []any{key},
+		"count":        count,
+		"time":         time.Now(),
+	}
+	headers["x-death"] = append([]any{entry}, kept...)
+
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = queue
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = exchange
+	}
+}
+
+func (b *MemoryBroker) NewConfirmPublisher(mandatory bool, timeout time.Duration) BatchPublisher {
+	return &memConfirmPublisher{b: b, mandatory: mandatory}
+}
+
+type memConfirmPublisher struct {
+	b         *MemoryBroker
+	mandatory bool
+}
+
+func (p *memConfirmPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+
+	if p.b.closed {
+		return errors.New("broker is closed")
+	}
+	routed, err := p.b.route(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if p.mandatory && routed == 0 {
+		return &ReturnError{Exchange: exchange, RoutingKey: key, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	return nil
+}
+
+func (p *memConfirmPublisher) PublishBatch(ctx context.Context, msgs []BatchMessage) []error {
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = p.Publish(ctx, m.Exchange, m.Key, m.Msg)
+	}
+	return errs
+}
+
+func argInt(args map[string]any, key string) (int64, bool) {
+	switch v := args[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
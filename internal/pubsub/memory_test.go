@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.extra", false},
+		{"*.alice", "army_moves.alice", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice.europe", true},
+		{"#", "anything.at.all", true},
+		{"#.europe", "moves.alice.europe", true},
+		{"#.europe", "moves.alice.asia", false},
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.c.z", true},
+		{"a.*.z", "a.z", false},
+		{"pause", "pause", true},
+		{"pause", "resume", false},
+	}
+	for _, tt := range tests {
+		got := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+		if got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDirectRouting(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "pause.alice", "pause", "direct")
+	declareBound(t, b, "other", "other", "direct")
+
+	mustNoErr(t, b.Publish(context.Background(), "direct", "pause", Publishing{Body: []byte("hi")}))
+
+	d, ok, err := b.Get("pause.alice")
+	mustNoErr(t, err)
+	if !ok || string(d.Body) != "hi" || d.Exchange != "direct" || d.RoutingKey != "pause" {
+		t.Fatalf("got %+v, %v", d, ok)
+	}
+	mustNoErr(t, d.Ack())
+	if _, ok, _ := b.Get("other"); ok {
+		t.Fatal("message routed to a queue bound with another key")
+	}
+}
+
+func TestMemoryNackRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+	c, err := b.Consume("q", 1)
+	mustNoErr(t, err)
+	defer c.Close()
+
+	mustNoErr(t, b.Publish(context.Background(), "direct", "k", Publishing{Body: []byte("x")}))
+	first := receive(t, c.Deliveries())
+	if first.Redelivered {
+		t.Fatal("first delivery marked redelivered")
+	}
+	mustNoErr(t, first.Nack(true))
+
+	second := receive(t, c.Deliveries())
+	if !second.Redelivered || string(second.Body) != "x" {
+		t.Fatalf("got %+v, want the same message redelivered", second)
+	}
+	mustNoErr(t, second.Ack())
+}
+
+func TestMemoryNackDiscardDeadLetters(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	_, err := b.DeclareQueue(QueueSpec{Name: "q", Args: map[string]any{"x-dead-letter-exchange": routing.ExchangePerilDLX}})
+	mustNoErr(t, err)
+	mustNoErr(t, b.BindQueue("q", "army_moves.*", routing.ExchangePerilTopic))
+	c, err := b.Consume("q", 1)
+	mustNoErr(t, err)
+	defer c.Close()
+
+	mustNoErr(t, b.Publish(context.Background(), routing.ExchangePerilTopic, "army_moves.alice", Publishing{Body: []byte("x")}))
+	mustNoErr(t, receive(t, c.Deliveries()).Nack(false))
+
+	dead, ok, err := b.Get(routing.QueuePerilDLQ)
+	mustNoErr(t, err)
+	if !ok {
+		t.Fatal("nothing dead-lettered")
+	}
+	if dead.RoutingKey != "army_moves.alice" {
+		t.Errorf("routing key %q, want the original", dead.RoutingKey)
+	}
+	death := firstDeath(t, dead)
+	if death["queue"] != "q" || death["reason"] != "rejected" || death["exchange"] != routing.ExchangePerilTopic || death["count"] != int64(1) {
+		t.Errorf("x-death = %v", death)
+	}
+	if dead.Headers["x-first-death-reason"] != "rejected" {
+		t.Errorf("x-first-death-reason = %v", dead.Headers["x-first-death-reason"])
+	}
+}
+
+func TestMemoryTTLExpiry(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	_, err := b.DeclareQueue(QueueSpec{Name: "q", Args: map[string]any{
+		"x-message-ttl":          int64(20),
+		"x-dead-letter-exchange": routing.ExchangePerilDLX,
+	}})
+	mustNoErr(t, err)
+
+	mustNoErr(t, b.Publish(context.Background(), "", "q", Publishing{Body: []byte("x")}))
+	if _, ok, _ := b.Get(routing.QueuePerilDLQ); ok {
+		t.Fatal("dead-lettered before the TTL")
+	}
+
+	dead := waitForGet(t, b, routing.QueuePerilDLQ)
+	if death := firstDeath(t, dead); death["reason"] != "expired" {
+		t.Errorf("x-death = %v", death)
+	}
+	if _, ok, _ := b.Get("q"); ok {
+		t.Fatal("expired message still in its queue")
+	}
+}
+
+func mustNoErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func declareBound(t *testing.T, b *MemoryBroker, queue, key, exchange string) {
+	t.Helper()
+	_, err := b.DeclareQueue(QueueSpec{Name: queue})
+	mustNoErr(t, err)
+	mustNoErr(t, b.BindQueue(queue, key, exchange))
+}
+
+func receive(t *testing.T, ch <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return Delivery{}
+	}
+}
+
+func waitForGet(t *testing.T, b *MemoryBroker, queue string) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		d, ok, err := b.Get(queue)
+		mustNoErr(t, err)
+		if ok {
+			return d
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("nothing arrived on %s", queue)
+	return Delivery{}
+}
+
+func firstDeath(t *testing.T, d Delivery) map[string]any {
+	t.Helper()
+	deaths, _ := d.Headers["x-death"].([]any)
+	if len(deaths) == 0 {
+		t.Fatalf("no x-death header in %v", d.Headers)
+	}
+	return deaths[0].(map[string]any)
+}
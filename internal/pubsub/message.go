@@ -0,0 +1,38 @@
+package pubsub
+
+import "context"
+
+// Message is a decoded delivery together with the metadata it arrived with.
+type Message[T any] struct {
+	Body T
+	Envelope
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	ContentType string
+	Headers     map[string]any
+}
+
+func newMessage[T any](d Delivery, body T) Message[T] {
+	return Message[T]{
+		Body:        body,
+		Envelope:    EnvelopeOf(d),
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		Redelivered: d.Redelivered,
+		ContentType: d.ContentType,
+		Headers:     d.Headers,
+	}
+}
+
+// MessageHandler handles a message with its metadata. ctx stays live while a
+// closed subscription drains and is cancelled once the drain is over or has
+// taken longer than ten seconds.
+type MessageHandler[T any] func(ctx context.Context, msg Message[T]) AckType
+
+// Adapt lets a handler that only needs the body run as a MessageHandler.
+func Adapt[T any](h func(T) AckType) MessageHandler[T] {
+	return func(ctx context.Context, msg Message[T]) AckType {
+		return h(msg.Body)
+	}
+}
@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "published_total",
+		Help:      "Messages published, by exchange, routing key and result.",
+	}, []string{"exchange", "routing_key", "result"})
+
+	consumedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "consumed_total",
+		Help:      "Messages delivered to subscribers, by queue, exchange and routing key.",
+	}, []string{"queue", "exchange", "routing_key"})
+
+	acksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "acks_total",
+		Help:      "Handler outcomes, by queue and ack type.",
+	}, []string{"queue", "ack"})
+
+	decodeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "decode_errors_total",
+		Help:      "Deliveries that could not be decoded, by queue.",
+	}, []string{"queue"})
+
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in subscription handlers, by queue.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "in_flight",
+		Help:      "Deliveries currently being handled, by queue.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(publishedTotal, consumedTotal, acksTotal, decodeErrorsTotal, handlerDuration, inFlight)
+}
+
+func publishResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
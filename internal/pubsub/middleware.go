@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+type Handler[T any] func(T) AckType
+
+type Middleware[T any] func(MessageHandler[T]) MessageHandler[T]
+
+// Chain wraps h in mws. The first middleware is the outermost, so it sees the
+// message first and the ack type last.
+func Chain[T any](h MessageHandler[T], mws ...Middleware[T]) MessageHandler[T] {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// FromError adapts a handler that only reports success or failure. A nil error
+// acks the message and any other error is printed, kept as the failure reason
+// and answered with onErr.
+func FromError[T any](fn func(T) error, onErr AckType) MessageHandler[T] {
+	return func(ctx context.Context, msg Message[T]) AckType {
+		err := fn(msg.Body)
+		if err != nil {
+			fmt.Printf("Error handling %T: %v\n", msg.Body, err)
+			SetFailureReason(ctx, err.Error())
+			return onErr
+		}
+		return Ack
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard instead of taking the
+// consumer goroutine, and with it the whole process, down.
+func Recover[T any](next MessageHandler[T]) MessageHandler[T] {
+	return func(ctx context.Context, msg Message[T]) (ack AckType) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("Handler panicked on %s: %v\n%s", msg.RoutingKey, r, debug.Stack())
+				ack = NackDiscard
+			}
+		}()
+		return next(ctx, msg)
+	}
+}
+
+func Logging[T any](next MessageHandler[T]) MessageHandler[T] {
+	return func(ctx context.Context, msg Message[T]) AckType {
+		ack := next(ctx, msg)
+		fmt.Printf("Handled %s %s from %s: %v\n", msg.Type, msg.MessageID, msg.RoutingKey, ack)
+		return ack
+	}
+}
+
+// Timing reports how long each call took along with its result.
+func Timing[T any](observe func(d time.Duration, ack AckType)) Middleware[T] {
+	return func(next MessageHandler[T]) MessageHandler[T] {
+		return func(ctx context.Context, msg Message[T]) AckType {
+			start := time.Now()
+			ack := next(ctx, msg)
+			observe(time.Since(start), ack)
+			return ack
+		}
+	}
+}
+
+// RedrawPrompt prints the REPL prompt again once the handler is done, since
+// its output lands in the middle of whatever the user was typing.
+func RedrawPrompt[T any](next MessageHandler[T]) MessageHandler[T] {
+	return func(ctx context.Context, msg Message[T]) AckType {
+		defer fmt.Print("> ")
+		return next(ctx, msg)
+	}
+}
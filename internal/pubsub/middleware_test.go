@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRecoverDiscardsAndKeepsConsuming(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	handled := make(chan string, 1)
+	handler := Recover(func(ctx context.Context, msg Message[string]) AckType {
+		if msg.Body == "boom" {
+			panic("handler bug")
+		}
+		handled <- msg.Body
+		return Ack
+	})
+	sub, err := Subscribe(context.Background(), b, "direct", "q", "k", QueueDurable, handler)
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "boom"))
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "after"))
+	select {
+	case body := <-handled:
+		if body != "after" {
+			t.Errorf("handled %q, want the message after the panic", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription stopped consuming after a panic")
+	}
+
+	dead := waitForGet(t, b, routing.QueuePerilDLQ)
+	var body string
+	mustNoErr(t, JSON.Unmarshal(dead.Body, &body))
+	if body != "boom" {
+		t.Errorf("dead-lettered %q, want the message that panicked", body)
+	}
+	if reason := firstDeath(t, dead)["reason"]; reason != "rejected" {
+		t.Errorf("death reason %v, want rejected", reason)
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware[string] {
+		return func(next MessageHandler[string]) MessageHandler[string] {
+			return func(ctx context.Context, msg Message[string]) AckType {
+				calls = append(calls, name+" in")
+				ack := next(ctx, msg)
+				calls = append(calls, name+" out")
+				return ack
+			}
+		}
+	}
+	h := Chain(func(ctx context.Context, msg Message[string]) AckType {
+		calls = append(calls, "handler")
+		return NackRequeue
+	}, trace("first"), trace("second"))
+
+	if ack := h(context.Background(), Message[string]{Body: "x"}); ack != NackRequeue {
+		t.Errorf("ack = %v, want the handler's", ack)
+	}
+	want := []string{"first in", "second in", "handler", "second out", "first out"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
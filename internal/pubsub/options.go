@@ -0,0 +1,54 @@
+package pubsub
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	workers       int
+	prefetch      int
+	keyOrdering   bool
+	retry         *RetryPolicy
+	defaultCodec  Codec
+	poison        PoisonPolicy
+	onDecodeError func(Delivery, error)
+}
+
+func defaultSubscribeOptions() subscribeOptions {
+	return subscribeOptions{
+		workers:       1,
+		prefetch:      10,
+		defaultCodec:  JSON,
+		poison:        PoisonDeadLetter,
+		onDecodeError: printDecodeError,
+	}
+}
+
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n >= 0 {
+			o.prefetch = n
+		}
+	}
+}
+
+// WithKeyOrdering pins every routing key to a single worker, so messages that
+// share a key are handled in the order they were delivered.
+func WithKeyOrdering() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.keyOrdering = true
+	}
+}
+
+// WithDefaultCodec sets the codec used for deliveries without a content type.
+func WithDefaultCodec(c Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.defaultCodec = c
+	}
+}
@@ -0,0 +1,245 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+type OutboxEntry struct {
+	Exchange string
+	Key      string
+	Msg      Publishing
+	Attempts int
+}
+
+// OutboxStore keeps staged messages until the relay has them confirmed.
+// Entries are identified by their message ID.
+type OutboxStore interface {
+	Append(entries ...OutboxEntry) error
+	Pending() ([]OutboxEntry, error)
+	Update(entry OutboxEntry) error
+	Remove(messageID string) error
+}
+
+// Outbox pairs a local state change with the messages announcing it. Both are
+// recorded in one Transact call and a relay goroutine publishes the messages
+// in order, retrying with confirms until the broker has them. A retried
+// message keeps its message ID so subscribers can recognise a duplicate.
+type Outbox struct {
+	store     OutboxStore
+	pub       Publisher
+	interval  time.Duration
+	maxDelay  time.Duration
+	onPublish func(OutboxEntry, error)
+
+	mu     sync.Mutex
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type OutboxOption func(*Outbox)
+
+// WithRelayBackoff sets how long the relay waits after a failed publish,
+// doubling up to max while the broker keeps failing.
+func WithRelayBackoff(initial, max time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.interval = initial
+		o.maxDelay = max
+	}
+}
+
+// WithPublishHandler is called after every relay attempt with a nil error on
+// success.
+func WithPublishHandler(fn func(OutboxEntry, error)) OutboxOption {
+	return func(o *Outbox) {
+		o.onPublish = fn
+	}
+}
+
+// NewOutbox starts a relay publishing through pub, which should be a confirm
+// publisher so a nil error means the broker really took the message.
+func NewOutbox(store OutboxStore, pub Publisher, opts ...OutboxOption) *Outbox {
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		store:    store,
+		pub:      pub,
+		interval: 500 * time.Millisecond,
+		maxDelay: 30 * time.Second,
+		wake:     make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	go o.relay(ctx)
+	o.notify()
+	return o
+}
+
+// OutboxTx collects the messages staged during one Transact call.
+type OutboxTx struct {
+	ctx     context.Context
+	entries []OutboxEntry
+}
+
+// Stage encodes val for publishing once the surrounding transaction commits.
+func Stage[T any](tx *OutboxTx, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := encode(codec, val, opts)
+	if err != nil {
+		return err
+	}
+	otel.GetTextMapPropagator().Inject(tx.ctx, headerCarrier(msg.Headers))
+	tx.entries = append(tx.entries, OutboxEntry{Exchange: exchange, Key: key, Msg: msg})
+	return nil
+}
+
+// Transact runs fn, which changes local state and stages the messages that go
+// with it. Nothing is recorded if fn returns an error, so fn must not change
+// state before it knows it will succeed. Transactions are serialised, which
+// keeps staged messages in the order their state changes happened.
+func (o *Outbox) Transact(ctx context.Context, fn func(tx *OutboxTx) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	tx := &OutboxTx{ctx: ctx}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if len(tx.entries) == 0 {
+		return nil
+	}
+	err = o.store.Append(tx.entries...)
+	if err != nil {
+		return fmt.Errorf("Couldn't record outbox messages: %w", err)
+	}
+	o.notify()
+	return nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the relay and reports how many messages were never published.
+func (o *Outbox) Close() (int, error) {
+	o.cancel()
+	<-o.done
+	pending, err := o.store.Pending()
+	return len(pending), err
+}
+
+func (o *Outbox) relay(ctx context.Context) {
+	defer close(o.done)
+	delay := o.interval
+	for {
+		var retry <-chan time.Time
+		if !o.flush(ctx) {
+			retry = time.After(delay)
+			delay = min(delay*2, o.maxDelay)
+		} else {
+			delay = o.interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-retry:
+		}
+	}
+}
+
+// flush publishes pending entries in order and reports whether it got through
+// all of them.
+func (o *Outbox) flush(ctx context.Context) bool {
+	pending, err := o.store.Pending()
+	if err != nil {
+		fmt.Printf("Error reading outbox: %v\n", err)
+		return false
+	}
+	for _, entry := range pending {
+		msg := entry.Msg
+		msg.Headers = maps.Clone(entry.Msg.Headers)
+		pubCtx := otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Headers))
+
+		err := publishMessage(pubCtx, o.pub, entry.Exchange, entry.Key, msg)
+		entry.Attempts++
+		if o.onPublish != nil {
+			o.onPublish(entry, err)
+		}
+
+		// A returned message reached the broker and nobody was listening;
+		// publishing it again would not change that.
+		var returned *ReturnError
+		if err != nil && !errors.As(err, &returned) {
+			if ctx.Err() == nil {
+				o.store.Update(entry)
+			}
+			return false
+		}
+		err = o.store.Remove(entry.Msg.MessageID)
+		if err != nil {
+			fmt.Printf("Error removing %s from outbox: %v\n", entry.Msg.MessageID, err)
+			return false
+		}
+	}
+	return true
+}
+
+type MemoryOutboxStore struct {
+	mu      sync.Mutex
+	entries []OutboxEntry
+}
+
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{}
+}
+
+func (s *MemoryOutboxStore) Append(entries ...OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *MemoryOutboxStore) Pending() ([]OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OutboxEntry(nil), s.entries...), nil
+}
+
+func (s *MemoryOutboxStore) Update(entry OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.Msg.MessageID == entry.Msg.MessageID {
+			s.entries[i] = entry
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox entry %s: %w", entry.Msg.MessageID, ErrNotFound)
+}
+
+func (s *MemoryOutboxStore) Remove(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.Msg.MessageID == messageID {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox entry %s: %w", messageID, ErrNotFound)
+}
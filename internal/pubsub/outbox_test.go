@@ -0,0 +1,202 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPublisher fails the first failures publishes and then hands the rest
+// to pub.
+type flakyPublisher struct {
+	pub Publisher
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	p.mu.Lock()
+	if p.failures > 0 {
+		p.failures--
+		p.mu.Unlock()
+		return errors.New("connection reset")
+	}
+	p.mu.Unlock()
+	return p.pub.Publish(ctx, exchange, key, msg)
+}
+
+func stageAll(t *testing.T, o *Outbox, vals ...int) {
+	t.Helper()
+	err := o.Transact(context.Background(), func(tx *OutboxTx) error {
+		for _, v := range vals {
+			err := Stage(tx, JSON, "direct", "k", v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustNoErr(t, err)
+}
+
+func receiveInts(t *testing.T, b *MemoryBroker, queue string, n int) []int {
+	t.Helper()
+	got := make([]int, n)
+	for i := range got {
+		mustNoErr(t, JSON.Unmarshal(waitForGet(t, b, queue).Body, &got[i]))
+	}
+	return got
+}
+
+func TestOutboxPublishesInTransactOrder(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+	o := NewOutbox(NewMemoryOutboxStore(), b.NewConfirmPublisher(true, time.Second))
+
+	stageAll(t, o, 1, 2)
+	stageAll(t, o, 3)
+	stageAll(t, o, 4, 5, 6)
+	got := receiveInts(t, b, "q", 6)
+	for i, v := range got {
+		if v != i+1 {
+			t.Fatalf("published %v, want 1 through 6 in order", got)
+		}
+	}
+	unsent, err := o.Close()
+	mustNoErr(t, err)
+	if unsent != 0 {
+		t.Errorf("%d unsent after everything was published", unsent)
+	}
+}
+
+func TestOutboxRetriesFailedPublishes(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+
+	var mu sync.Mutex
+	var attempts []OutboxEntry
+	pub := &flakyPublisher{pub: b.NewConfirmPublisher(true, time.Second), failures: 3}
+	o := NewOutbox(NewMemoryOutboxStore(), pub,
+		WithRelayBackoff(time.Millisecond, 5*time.Millisecond),
+		WithPublishHandler(func(e OutboxEntry, err error) {
+			mu.Lock()
+			attempts = append(attempts, e)
+			mu.Unlock()
+		}))
+	defer o.Close()
+
+	stageAll(t, o, 1, 2)
+	got := receiveInts(t, b, "q", 2)
+	if got[0] != 1 || got[1] != 2 {
+		t.Errorf("published %v, want [1 2]", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 5 {
+		t.Fatalf("%d attempts, want 3 failures and 2 successes", len(attempts))
+	}
+	first := attempts[0].Msg.MessageID
+	for i, e := range attempts[:4] {
+		if e.Msg.MessageID != first || e.Attempts != i+1 {
+			t.Errorf("attempt %d: %s try %d, want %s try %d", i, e.Msg.MessageID, e.Attempts, first, i+1)
+		}
+	}
+	if attempts[4].Msg.MessageID == first {
+		t.Error("second message published before the first got through")
+	}
+}
+
+func TestOutboxDropsReturnedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+
+	errs := make(chan error, 2)
+	o := NewOutbox(NewMemoryOutboxStore(), b.NewConfirmPublisher(true, time.Second),
+		WithPublishHandler(func(e OutboxEntry, err error) { errs <- err }))
+
+	err := o.Transact(context.Background(), func(tx *OutboxTx) error {
+		err := Stage(tx, JSON, "direct", "nobody", "lost")
+		if err != nil {
+			return err
+		}
+		return Stage(tx, JSON, "direct", "k", "delivered")
+	})
+	mustNoErr(t, err)
+
+	var returned *ReturnError
+	if err := <-errs; !errors.As(err, &returned) {
+		t.Errorf("first publish err = %v, want a ReturnError", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("second publish err = %v", err)
+	}
+	var body string
+	mustNoErr(t, JSON.Unmarshal(waitForGet(t, b, "q").Body, &body))
+	if body != "delivered" {
+		t.Errorf("got %q", body)
+	}
+	unsent, err := o.Close()
+	mustNoErr(t, err)
+	if unsent != 0 {
+		t.Errorf("returned message left in the outbox: %d unsent", unsent)
+	}
+}
+
+func TestOutboxCloseCountsUnsent(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	declareBound(t, b, "q", "k", "direct")
+
+	attempted := make(chan struct{}, 1)
+	pub := &flakyPublisher{pub: b, failures: 1 << 30}
+	store := NewMemoryOutboxStore()
+	o := NewOutbox(store, pub, WithRelayBackoff(time.Hour, time.Hour),
+		WithPublishHandler(func(OutboxEntry, error) {
+			select {
+			case attempted <- struct{}{}:
+			default:
+			}
+		}))
+	stageAll(t, o, 1, 2, 3)
+	<-attempted
+
+	unsent, err := o.Close()
+	mustNoErr(t, err)
+	if unsent != 3 {
+		t.Errorf("Close reported %d unsent, want 3", unsent)
+	}
+	pending, err := store.Pending()
+	mustNoErr(t, err)
+	if len(pending) != 3 || pending[0].Attempts == 0 {
+		t.Errorf("pending = %+v, want all three with the failed attempt counted", pending)
+	}
+}
+
+func TestOutboxFailedTransactRecordsNothing(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	store := NewMemoryOutboxStore()
+	o := NewOutbox(store, b)
+	defer o.Close()
+
+	invalid := errors.New("not enough units")
+	err := o.Transact(context.Background(), func(tx *OutboxTx) error {
+		mustNoErr(t, Stage(tx, JSON, "direct", "k", "move"))
+		return invalid
+	})
+	if !errors.Is(err, invalid) {
+		t.Errorf("Transact err = %v, want fn's", err)
+	}
+	pending, err := store.Pending()
+	mustNoErr(t, err)
+	if len(pending) != 0 {
+		t.Errorf("failed transaction recorded %d entries", len(pending))
+	}
+}
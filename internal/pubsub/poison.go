@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// PoisonPolicy decides what happens to a delivery whose body can't be decoded.
+type PoisonPolicy int
+
+const (
+	// PoisonDeadLetter publishes the message to peril_dlx with the decode
+	// error in the x-failure-reason header.
+	PoisonDeadLetter PoisonPolicy = iota
+	// PoisonReject nacks the message without requeueing it, leaving it to the
+	// queue's own dead-letter settings.
+	PoisonReject
+	// PoisonQuarantine moves the message to <queue>.quarantine.
+	PoisonQuarantine
+)
+
+func WithPoisonPolicy(p PoisonPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.poison = p
+	}
+}
+
+// WithDecodeErrorHandler is called for every delivery that fails to decode,
+// before the poison policy is applied.
+func WithDecodeErrorHandler(fn func(Delivery, error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onDecodeError = fn
+	}
+}
+
+func printDecodeError(msg Delivery, err error) {
+	fmt.Printf("Error unmarshalling data: %v\n", err)
+}
+
+func QuarantineQueue(queue string) string {
+	return queue + ".quarantine"
+}
+
+type poisonHandler struct {
+	b       Broker
+	pub     Publisher
+	queue   string
+	durable bool
+	policy  PoisonPolicy
+}
+
+func (p *poisonHandler) declare() error {
+	if p.policy != PoisonQuarantine {
+		return nil
+	}
+	_, err := p.b.DeclareQueue(QueueSpec{
+		Name:    QuarantineQueue(p.queue),
+		Durable: p.durable,
+	})
+	if err != nil {
+		return fmt.Errorf("Couldn't declare quarantine queue: %w", err)
+	}
+	return nil
+}
+
+func (p *poisonHandler) forget() {
+	if p.policy == PoisonQuarantine {
+		forgetQueue(p.b, QuarantineQueue(p.queue))
+	}
+}
+
+func (p *poisonHandler) handle(ctx context.Context, msg Delivery, decodeErr error) error {
+	if p.policy == PoisonReject {
+		return msg.Nack(false)
+	}
+
+	pub := failedCopy(msg)
+	pub.Headers[HeaderFailureReason] = fmt.Sprintf("decode: %v", decodeErr)
+	exchange, key := "", QuarantineQueue(p.queue)
+	if p.policy != PoisonQuarantine {
+		exchange = routing.ExchangePerilDLX
+		key, _ = pub.Headers[HeaderOriginalRoutingKey].(string)
+	}
+
+	// The original is only acked once its copy has been confirmed. Requeueing
+	// it on failure would redeliver it straight back here, so it is rejected
+	// instead and left to the queue's own dead-letter settings.
+	err := p.pub.Publish(ctx, exchange, key, pub)
+	if err != nil {
+		msg.Nack(false)
+		return fmt.Errorf("%w: %w", ErrPublishFailed, err)
+	}
+	return msg.Ack()
+}
+
+// failedCopy copies msg for republishing elsewhere, remembering where it was
+// first published so it can be replayed from the DLQ.
+func failedCopy(msg Delivery) Publishing {
+	pub := msg.Publishing
+	pub.Headers = maps.Clone(msg.Headers)
+	if pub.Headers == nil {
+		pub.Headers = map[string]any{}
+	}
+	if _, ok := pub.Headers[HeaderOriginalExchange]; !ok {
+		pub.Headers[HeaderOriginalExchange] = msg.Exchange
+		pub.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	}
+	return pub
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestPoisonDeadLetters(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	handler := Adapt(func(s routing.PlayingState) AckType { return Ack })
+	sub, err := Subscribe(context.Background(), b, "direct", "pause.alice", "pause", QueueTransient, handler)
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	mustNoErr(t, b.Publish(context.Background(), "direct", "pause", Publishing{ContentType: "application/json", Body: []byte("{not json")}))
+	dead := waitForGet(t, b, routing.QueuePerilDLQ)
+	reason, _ := dead.Headers[HeaderFailureReason].(string)
+	if !strings.HasPrefix(reason, "decode: ") {
+		t.Errorf("failure reason %q", reason)
+	}
+	if dead.RoutingKey != "pause" {
+		t.Errorf("routing key %q, want the original", dead.RoutingKey)
+	}
+}
+
+func TestPoisonCopyFailureDoesNotRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	// peril_dlx exists but nothing is bound to it, so the copy is returned.
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: routing.ExchangePerilDLX, Kind: ExchangeFanout}))
+
+	var failures atomic.Int32
+	handler := Adapt(func(s routing.PlayingState) AckType { return Ack })
+	sub, err := Subscribe(context.Background(), b, "direct", "pause.alice", "pause", QueueTransient, handler,
+		WithDecodeErrorHandler(func(Delivery, error) { failures.Add(1) }))
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	mustNoErr(t, b.Publish(context.Background(), "direct", "pause", Publishing{ContentType: "application/json", Body: []byte("{not json")}))
+	deadline := time.Now().Add(time.Second)
+	for failures.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := failures.Load(); n != 1 {
+		t.Fatalf("poison message handled %d times, want once", n)
+	}
+	if _, ok, _ := b.Get("pause.alice"); ok {
+		t.Error("poison message requeued after its copy failed")
+	}
+}
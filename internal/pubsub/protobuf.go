@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var Protobuf Codec = protobufCodec{}
+
+func init() {
+	RegisterCodec(Protobuf)
+}
+
+type protoMapping struct {
+	newMessage func() proto.Message
+	toProto    func(any) proto.Message
+	fromProto  func(proto.Message) any
+}
+
+var (
+	protoMappingsMu sync.RWMutex
+	protoMappings   = map[reflect.Type]protoMapping{}
+)
+
+// RegisterProtoMapping lets the protobuf codec carry T, which is not itself a
+// proto.Message, by converting it to and from P.
+func RegisterProtoMapping[T any, P proto.Message](to func(T) P, from func(P) T) {
+	protoMappingsMu.Lock()
+	defer protoMappingsMu.Unlock()
+	var zero P
+	protoMappings[reflect.TypeFor[T]()] = protoMapping{
+		newMessage: func() proto.Message { return zero.ProtoReflect().New().Interface() },
+		toProto:    func(v any) proto.Message { return to(v.(T)) },
+		fromProto:  func(m proto.Message) any { return from(m.(P)) },
+	}
+}
+
+func protoMappingFor(t reflect.Type) (protoMapping, error) {
+	protoMappingsMu.RLock()
+	defer protoMappingsMu.RUnlock()
+	m, ok := protoMappings[t]
+	if !ok {
+		return protoMapping{}, fmt.Errorf("no protobuf mapping registered for %v", t)
+	}
+	return m, nil
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	mapping, err := protoMappingFor(reflect.TypeOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(mapping.toProto(v))
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("protobuf: cannot unmarshal into %T", v)
+	}
+	// Subscribe[*perilpb.ArmyMove] hands us a **ArmyMove.
+	if rv.Elem().Kind() == reflect.Pointer {
+		if _, ok := rv.Elem().Interface().(proto.Message); ok {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+			return proto.Unmarshal(data, rv.Elem().Interface().(proto.Message))
+		}
+	}
+	mapping, err := protoMappingFor(rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	m := mapping.newMessage()
+	err = proto.Unmarshal(data, m)
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(reflect.ValueOf(mapping.fromProto(m)))
+	return nil
+}
@@ -1,60 +1,71 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
-	"log"
+	"fmt"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	bytes, err := json.Marshal(val)
+func Publish[T any](ctx context.Context, pub Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := encode(codec, val, opts)
 	if err != nil {
 		return err
 	}
-	pub := amqp.Publishing{
-		ContentType: "application/json",
-		Body:        bytes,
-	}
-	err = ch.PublishWithContext(context.Background(), exchange, key, false, false, pub)
+	return publishMessage(ctx, pub, exchange, key, msg)
+}
+
+func encode[T any](codec Codec, val T, opts []PublishOption) (Publishing, error) {
+	body, err := codec.Marshal(val)
 	if err != nil {
-		log.Fatalf("Error publishing to channel: %v\n", err)
+		return Publishing{}, err
 	}
-	return nil
+	msg := Publishing{
+		ContentType: codec.ContentType(),
+		Body:        body,
+	}
+	newEnvelope[T](opts).apply(&msg)
+	return msg, nil
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var net bytes.Buffer
-	enc := gob.NewEncoder(&net)
-	err := enc.Encode(val)
+func publishMessage(ctx context.Context, pub Publisher, exchange, key string, msg Publishing) error {
+	ctx, span := startPublishSpan(ctx, exchange, key, &msg)
+	defer span.End()
+	err := pub.Publish(ctx, exchange, key, msg)
+	publishedTotal.WithLabelValues(exchange, key, publishResult(err)).Inc()
 	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrPublishFailed, err)
+		recordSpanError(span, err)
 		return err
 	}
-	pub := amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        net.Bytes(),
-	}
-	err = ch.PublishWithContext(context.Background(), exchange, key, false, false, pub)
+	return nil
+}
+
+func PublishJSON[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(context.Background(), pub, JSON, exchange, key, val, opts...)
+}
+
+func PublishGob[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(context.Background(), pub, Gob, exchange, key, val, opts...)
+}
+
+func PublishGameLog(ctx context.Context, pub Publisher, username, message string, opts ...PublishOption) error {
+	err := Publish(ctx, pub, Gob, routing.ExchangePerilTopic, routing.GameLogSlug+"."+username, newGameLog(username, message), append([]PublishOption{WithSender(username)}, opts...)...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func PublishGameLog(ch *amqp.Channel, username, message string) error {
-	gl := routing.GameLog{
+func BatchGameLog(ctx context.Context, b *Batch, username, message string, opts ...PublishOption) *PublishResult {
+	return AddToBatch(ctx, b, Gob, routing.ExchangePerilTopic, routing.GameLogSlug+"."+username, newGameLog(username, message), append([]PublishOption{WithSender(username)}, opts...)...)
+}
+
+func newGameLog(username, message string) routing.GameLog {
+	return routing.GameLog{
 		Username:    username,
 		Message:     message,
 		CurrentTime: time.Now(),
 	}
-	err := PublishGob(ch, routing.ExchangePerilTopic, routing.GameLogSlug+"."+username, gl)
-	if err != nil {
-		return err
-	}
-	return nil
 }
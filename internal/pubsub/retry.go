@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const (
+	HeaderRetryCount         = "x-retry-count"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderFailureReason      = "x-failure-reason"
+)
+
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if time.Duration(d) >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return time.Duration(d)
+}
+
+// WithRetry makes NackRetry park the message in a delay queue that
+// dead-letters back into the subscription's queue once its TTL expires. After
+// MaxAttempts the message is sent to peril_dlx. Either way it carries the
+// reason the handler gave through SetFailureReason, if any.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+type retrier struct {
+	b       Broker
+	pub     Publisher
+	queue   string
+	durable bool
+	policy  RetryPolicy
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+func newRetrier(b Broker, pub Publisher, queue string, durable bool, policy RetryPolicy) *retrier {
+	return &retrier{
+		b:        b,
+		pub:      pub,
+		queue:    queue,
+		durable:  durable,
+		policy:   policy,
+		declared: map[string]bool{},
+	}
+}
+
+type failureReasonKey struct{}
+
+// SetFailureReason records why a handler is about to return NackRetry, for
+// the x-failure-reason header on the retried or dead-lettered copy.
+func SetFailureReason(ctx context.Context, reason string) {
+	if p, ok := ctx.Value(failureReasonKey{}).(*string); ok {
+		*p = reason
+	}
+}
+
+func (r *retrier) retry(ctx context.Context, msg Delivery, reason string) error {
+	pub := failedCopy(msg)
+	attempt := int(headerInt(pub.Headers, HeaderRetryCount)) + 1
+	pub.Headers[HeaderRetryCount] = int64(attempt)
+	if reason != "" {
+		pub.Headers[HeaderFailureReason] = reason
+	}
+
+	if attempt >= r.policy.MaxAttempts {
+		key, _ := pub.Headers[HeaderOriginalRoutingKey].(string)
+		err := r.pub.Publish(ctx, routing.ExchangePerilDLX, key, pub)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrPublishFailed, err)
+		}
+		return nil
+	}
+
+	delayQueue, err := r.declare(r.policy.delay(attempt))
+	if err != nil {
+		return err
+	}
+	err = r.pub.Publish(ctx, "", delayQueue, pub)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPublishFailed, err)
+	}
+	return nil
+}
+
+// declare creates the delay queue for delay. A transient subscription's
+// queue disappears with its consumer, so its retry queues expire a while after
+// their last use instead of outliving it; they are redeclared on every retry,
+// which restarts that timer.
+func (r *retrier) declare(delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.retry.%d", r.queue, delay.Milliseconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.declared[name] {
+		return name, nil
+	}
+	args := map[string]any{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queue,
+	}
+	if !r.durable {
+		args["x-expires"] = (delay + time.Minute).Milliseconds()
+	}
+	_, err := r.b.DeclareQueue(QueueSpec{
+		Name:    name,
+		Durable: r.durable,
+		Args:    args,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't declare retry queue: %w", err)
+	}
+	r.declared[name] = r.durable
+	return name, nil
+}
+
+// forget drops the retry queues from the broker's reconnect replay once the
+// subscription is done with them.
+func (r *retrier) forget() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.declared {
+		forgetQueue(r.b, name)
+	}
+}
+
+func headerInt(headers map[string]any, key string) int64 {
+	n, _ := argInt(headers, key)
+	return n
+}
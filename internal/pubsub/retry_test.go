@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRetryGivesUpWithHandlerReason(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, DeclareTopology(b))
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1}
+	calls := 0
+	handler := FromError(func(s string) error {
+		calls++
+		return errors.New("disk full")
+	}, NackRetry)
+	sub, err := Subscribe(context.Background(), b, "direct", "logs.alice", "k", QueueTransient, handler, WithRetry(policy))
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "hello"))
+
+	dead := waitForGet(t, b, routing.QueuePerilDLQ)
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+	if dead.Headers[HeaderFailureReason] != "disk full" {
+		t.Errorf("failure reason %v, want the handler's error", dead.Headers[HeaderFailureReason])
+	}
+	if dead.Headers[HeaderRetryCount] != int64(3) {
+		t.Errorf("retry count %v, want 3", dead.Headers[HeaderRetryCount])
+	}
+	if dead.RoutingKey != "k" {
+		t.Errorf("routing key %q, want the original", dead.RoutingKey)
+	}
+
+	b.mu.Lock()
+	q := b.queues["logs.alice.retry.10"]
+	b.mu.Unlock()
+	if q == nil || q.spec.Durable || q.spec.Args["x-expires"] == nil {
+		t.Fatalf("retry queue for a transient subscription should expire, got %+v", q)
+	}
+}
+
+type forgettingBroker struct {
+	*MemoryBroker
+	forgotten chan string
+}
+
+func (b forgettingBroker) ForgetQueue(queueName string) {
+	b.forgotten <- queueName
+}
+
+func TestClosedSubscriptionForgetsRetryQueues(t *testing.T) {
+	b := forgettingBroker{NewMemoryBroker(), make(chan string, 10)}
+	mustNoErr(t, DeclareTopology(b))
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	policy := RetryPolicy{MaxAttempts: 2, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1}
+	retried := make(chan struct{}, 2)
+	sub, err := Subscribe(context.Background(), b, "direct", "logs.alice", "k", QueueTransient,
+		func(ctx context.Context, msg Message[string]) AckType {
+			retried <- struct{}{}
+			return NackRetry
+		}, WithRetry(policy))
+	mustNoErr(t, err)
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "hello"))
+	<-retried
+	waitForGet(t, b.MemoryBroker, routing.QueuePerilDLQ)
+
+	select {
+	case name := <-b.forgotten:
+		t.Fatalf("%s forgotten while the subscription is open", name)
+	default:
+	}
+	mustNoErr(t, sub.Close())
+	select {
+	case name := <-b.forgotten:
+		if name != "logs.alice.retry.10" {
+			t.Errorf("forgot %q, want the retry queue", name)
+		}
+	default:
+		t.Error("retry queue not forgotten after Close")
+	}
+}
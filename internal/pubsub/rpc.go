@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderRPCError     = "x-rpc-error"
+	HeaderRPCErrorCode = "x-rpc-error-code"
+)
+
+// RemoteError is the error a Serve handler answered a request with.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error (%s): %s", e.Code, e.Message)
+}
+
+// RPCClient owns the exclusive queue that replies to its requests come back
+// on and matches them to callers by correlation ID.
+type RPCClient struct {
+	b        Broker
+	pub      Publisher
+	queue    string
+	consumer Consumer
+	done     chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]chan Delivery
+	closed  bool
+}
+
+func NewRPCClient(b Broker) (*RPCClient, error) {
+	q, err := b.DeclareQueue(QueueSpec{
+		Name:       "rpc.reply." + NewMessageID(),
+		AutoDelete: true,
+		Exclusive:  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't declare reply queue: %w", err)
+	}
+	consumer, err := b.Consume(q.Name, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't consume replies: %w", err)
+	}
+
+	// Requests go out mandatory, so one nobody is serving fails with a
+	// ReturnError instead of waiting out its deadline.
+	c := &RPCClient{
+		b:        b,
+		pub:      b.NewConfirmPublisher(true, 5*time.Second),
+		queue:    q.Name,
+		consumer: consumer,
+		done:     make(chan struct{}),
+		pending:  map[string]chan Delivery{},
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *RPCClient) run() {
+	defer close(c.done)
+	for d := range c.consumer.Deliveries() {
+		c.mu.Lock()
+		reply, ok := c.pending[d.CorrelationID]
+		delete(c.pending, d.CorrelationID)
+		c.mu.Unlock()
+		if ok {
+			reply <- d
+		}
+		d.Ack()
+	}
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	err := c.consumer.Cancel()
+	<-c.done
+	return errors.Join(err, c.consumer.Close())
+}
+
+func (c *RPCClient) await(id string) (<-chan Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	reply := make(chan Delivery, 1)
+	c.pending[id] = reply
+	return reply, nil
+}
+
+func (c *RPCClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// Request publishes req as JSON and waits for the reply to it. A request that
+// can't be routed fails straight away; otherwise the wait is bounded only by
+// ctx, so callers should give it a deadline.
+func Request[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req) (Resp, error) {
+	var resp Resp
+	id := NewMessageID()
+	reply, err := c.await(id)
+	if err != nil {
+		return resp, err
+	}
+	defer c.forget(id)
+
+	err = Publish(ctx, c.pub, JSON, exchange, key, req, WithMessageID(id), WithReplyTo(c.queue))
+	if err != nil {
+		return resp, err
+	}
+
+	select {
+	case d := <-reply:
+		if msg, ok := d.Headers[HeaderRPCError].(string); ok {
+			code, _ := d.Headers[HeaderRPCErrorCode].(string)
+			return resp, &RemoteError{Code: code, Message: msg}
+		}
+		return decode[Resp](d, JSON)
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	}
+}
+
+// Serve answers requests sent with Request. A handler error is sent back as a
+// RemoteError; return a *RemoteError to pick its code.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(context.Context, Message[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	serve := func(ctx context.Context, msg Message[Req]) AckType {
+		if msg.ReplyTo == "" {
+			fmt.Printf("Dropping request %s without a reply-to queue\n", msg.MessageID)
+			return NackDiscard
+		}
+
+		var reply Publishing
+		resp, err := handler(ctx, msg)
+		if err != nil {
+			remote := &RemoteError{Code: "internal", Message: err.Error()}
+			errors.As(err, &remote)
+			reply, err = encode(JSON, remote, []PublishOption{WithCorrelationID(msg.MessageID)})
+			if err == nil {
+				reply.Headers[HeaderRPCError] = remote.Message
+				reply.Headers[HeaderRPCErrorCode] = remote.Code
+			}
+		} else {
+			reply, err = encode(JSON, resp, []PublishOption{WithCorrelationID(msg.MessageID)})
+		}
+		if err == nil {
+			err = publishMessage(ctx, b, "", msg.ReplyTo, reply)
+		}
+		if err != nil {
+			fmt.Printf("Error replying to %s: %v\n", msg.MessageID, err)
+			return NackDiscard
+		}
+		return Ack
+	}
+	return Subscribe(ctx, b, exchange, queueName, key, queueType, serve, opts...)
+}
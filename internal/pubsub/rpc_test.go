@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type statusRequest struct{ Username string }
+
+type statusReply struct{ Units int }
+
+func startStatusServer(t *testing.T, b *MemoryBroker) {
+	t.Helper()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	sub, err := Serve(context.Background(), b, "direct", "status.alice", "status.alice", QueueTransient,
+		func(ctx context.Context, msg Message[statusRequest]) (statusReply, error) {
+			if msg.Body.Username != "alice" {
+				return statusReply{}, &RemoteError{Code: "not_found", Message: "no such player"}
+			}
+			return statusReply{Units: 3}, nil
+		})
+	mustNoErr(t, err)
+	t.Cleanup(func() { sub.Close() })
+}
+
+func TestRequestReply(t *testing.T) {
+	b := NewMemoryBroker()
+	startStatusServer(t, b)
+	c, err := NewRPCClient(b)
+	mustNoErr(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := Request[statusRequest, statusReply](ctx, c, "direct", "status.alice", statusRequest{"alice"})
+	mustNoErr(t, err)
+	if resp.Units != 3 {
+		t.Errorf("got %+v", resp)
+	}
+
+	_, err = Request[statusRequest, statusReply](ctx, c, "direct", "status.alice", statusRequest{"bob"})
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != "not_found" {
+		t.Errorf("err = %v, want a not_found RemoteError", err)
+	}
+}
+
+func TestErrorReplyCarriesEnvelope(t *testing.T) {
+	b := NewMemoryBroker()
+	startStatusServer(t, b)
+	_, err := b.DeclareQueue(QueueSpec{Name: "replies"})
+	mustNoErr(t, err)
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "status.alice", statusRequest{"bob"}, WithMessageID("req-1"), WithReplyTo("replies")))
+	reply := waitForGet(t, b, "replies")
+	env := EnvelopeOf(reply)
+	if env.CorrelationID != "req-1" || env.MessageID == "" || env.Version == 0 || env.Timestamp.IsZero() {
+		t.Errorf("error reply envelope = %+v", env)
+	}
+	if reply.Headers[HeaderRPCErrorCode] != "not_found" {
+		t.Errorf("headers = %v", reply.Headers)
+	}
+}
+
+func TestRequestToNobodyFailsFast(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+	c, err := NewRPCClient(b)
+	mustNoErr(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = Request[statusRequest, statusReply](ctx, c, "direct", "status.offline", statusRequest{"offline"})
+	var returned *ReturnError
+	if !errors.As(err, &returned) {
+		t.Fatalf("err = %v, want a ReturnError", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("took %v to fail", time.Since(start))
+	}
+}
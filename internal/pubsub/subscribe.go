@@ -1,13 +1,14 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"sync"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type SimpleQueueType int
@@ -23,148 +24,274 @@ const (
 	Ack         AckType = iota //0
 	NackRequeue                //1
 	NackDiscard                //2
+	NackRetry                  //3
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case NackRetry:
+		return "nack-retry"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
+// Subscribe decodes each delivery with the codec registered for its content
+// type, falling back to the WithDefaultCodec codec when none is set, and hands
+// it to handler along with its metadata.
+func Subscribe[T any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler MessageHandler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, b, exchange, queueName, key, queueType, handler, opts)
+}
+
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe(
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-		handler,
-		func(data []byte) (T, error) {
-			var target T
-			err := json.Unmarshal(data, &target)
-			return target, err
-		},
-	)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultCodec(JSON)}, opts...)
+	return subscribe(ctx, b, exchange, queueName, key, queueType, Adapt(handler), opts)
 }
 
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe(
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-		handler,
-		func(data []byte) (T, error) {
-			out := bytes.NewBuffer(data)
-			dec := gob.NewDecoder(out)
-			var target T
-			err := dec.Decode(&target)
-			return target, err
-		},
-	)
-
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultCodec(Gob)}, opts...)
+	return subscribe(ctx, b, exchange, queueName, key, queueType, Adapt(handler), opts)
 }
 
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, _, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	handler MessageHandler[T],
+	opts []SubscribeOption,
+) (*Subscription, error) {
+	options := defaultSubscribeOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	_, err := DeclareAndBind(b, exchange, queueName, key, queueType)
 	if err != nil {
-		return fmt.Errorf("Couldn't declare and bind queue: %v", err)
+		return nil, fmt.Errorf("Couldn't declare and bind queue: %w", err)
 	}
 
-	err = ch.Qos(10, 0, false)
+	consumer, err := b.Consume(queueName, options.prefetch)
 	if err != nil {
-		return fmt.Errorf("Couldn't apply prefetch: %v", err)
+		return nil, fmt.Errorf("Couldn't consume messsages: %w", err)
+	}
+
+	// Retried and poisoned copies are confirmed before the original is acked.
+	confirmPub := b.NewConfirmPublisher(true, 5*time.Second)
+
+	var retrier *retrier
+	if options.retry != nil {
+		retrier = newRetrier(b, confirmPub, queueName, queueType == QueueDurable, *options.retry)
 	}
 
-	deliveryCh, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	poison := &poisonHandler{b: b, pub: confirmPub, queue: queueName, durable: queueType == QueueDurable, policy: options.poison}
+	err = poison.declare()
 	if err != nil {
-		return fmt.Errorf("Couldn't consume messsages: %v", err)
+		consumer.Close()
+		return nil, err
 	}
 
-	go func() {
-		defer ch.Close()
-		for msg := range deliveryCh {
-			data, err := unmarshaller(msg.Body)
+	sub := newSubscription(ctx, consumer)
+	handle := func(msg Delivery) {
+		spanCtx, span := startConsumeSpan(sub.handlerCtx, queueName, msg)
+		defer span.End()
+		consumedTotal.WithLabelValues(queueName, msg.Exchange, msg.RoutingKey).Inc()
+		inFlight.WithLabelValues(queueName).Inc()
+		defer inFlight.WithLabelValues(queueName).Dec()
+
+		data, err := decode[T](msg, options.defaultCodec)
+		if err != nil {
+			decodeErrorsTotal.WithLabelValues(queueName).Inc()
+			recordSpanError(span, err)
+			if options.onDecodeError != nil {
+				options.onDecodeError(msg, err)
+			}
+			err := poison.handle(sub.handlerCtx, msg, err)
 			if err != nil {
-				fmt.Printf("Error unmarshalling data: %v\n", err)
-				continue
+				fmt.Printf("Error handling undecodable message: %v\n", err)
 			}
-			switch handler(data) {
-			case Ack:
-				msg.Ack(false)
-			case NackDiscard:
-				msg.Nack(false, false)
-			case NackRequeue:
-				msg.Nack(false, true)
-			default:
-				log.Fatalf("Something went wrong: %v\n", err)
+			return
+		}
+		reason := new(string)
+		spanCtx = context.WithValue(spanCtx, failureReasonKey{}, reason)
+		start := time.Now()
+		ack := handler(spanCtx, newMessage(msg, data))
+		handlerDuration.WithLabelValues(queueName).Observe(time.Since(start).Seconds())
+		acksTotal.WithLabelValues(queueName, ack.String()).Inc()
+		span.SetAttributes(attribute.String("peril.ack", ack.String()))
+		switch ack {
+		case Ack:
+			msg.Ack()
+		case NackDiscard:
+			msg.Nack(false)
+		case NackRequeue:
+			msg.Nack(true)
+		case NackRetry:
+			if retrier == nil {
+				msg.Nack(true)
+				return
 			}
+			err := retrier.retry(sub.handlerCtx, msg, *reason)
+			if err != nil {
+				fmt.Printf("Error scheduling retry: %v\n", err)
+				msg.Nack(true)
+				return
+			}
+			msg.Ack()
+		default:
+			fmt.Printf("Error handling message: %v: %d\n", ErrUnknownAckType, ack)
+			msg.Nack(false)
+		}
+	}
+
+	go func() {
+		defer sub.finish()
+		dispatch(consumer.Deliveries(), options.workers, options.keyOrdering, handle)
+		if retrier != nil {
+			retrier.forget()
 		}
+		poison.forget()
 	}()
 
-	return nil
+	return sub, nil
+}
+
+// dispatch hands deliveries to a pool of workers and returns once deliveries
+// is closed and every worker has finished.
+func dispatch(deliveries <-chan Delivery, workers int, keyOrdering bool, handle func(Delivery)) {
+	if workers <= 1 {
+		for msg := range deliveries {
+			handle(msg)
+		}
+		return
+	}
+
+	queues := make([]chan Delivery, workers)
+	shared := make(chan Delivery)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = shared
+		if keyOrdering {
+			queues[i] = make(chan Delivery)
+		}
+		wg.Add(1)
+		go func(in <-chan Delivery) {
+			defer wg.Done()
+			for msg := range in {
+				handle(msg)
+			}
+		}(queues[i])
+	}
+
+	for msg := range deliveries {
+		if !keyOrdering {
+			shared <- msg
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(msg.RoutingKey))
+		queues[h.Sum32()%uint32(workers)] <- msg
+	}
+
+	if keyOrdering {
+		for _, q := range queues {
+			close(q)
+		}
+	} else {
+		close(shared)
+	}
+	wg.Wait()
 }
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
+) (Queue, error) {
 
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, amqp.Queue{}, err
+	spec := QueueSpec{
+		Name: queueName,
+		Args: map[string]any{
+			"x-dead-letter-exchange": routing.ExchangePerilDLX,
+		},
 	}
 
-	var durable bool
-	var autoDelete bool
-	var exclusive bool
-
 	switch queueType {
 	case QueueDurable:
-		durable = true
-		autoDelete = false
-		exclusive = false
+		spec.Durable = true
+		spec.AutoDelete = false
+		spec.Exclusive = false
 	case QueueTransient:
-		durable = false
-		autoDelete = true
-		exclusive = true
+		spec.Durable = false
+		spec.AutoDelete = true
+		spec.Exclusive = true
 	default:
-		log.Fatal("Unknown queue type!\n")
-	}
-
-	queueArgs := amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
+		return Queue{}, fmt.Errorf("%w: %d", ErrUnknownQueueType, queueType)
 	}
 
-	q, err := ch.QueueDeclare(queueName, durable, autoDelete, exclusive, false, queueArgs)
+	q, err := sub.DeclareQueue(spec)
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		return Queue{}, err
 	}
 
-	err = ch.QueueBind(queueName, key, exchange, false, nil)
+	err = sub.BindQueue(queueName, key, exchange)
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		return Queue{}, err
 	}
 
-	return ch, q, nil
+	return q, nil
+}
+
+func decode[T any](msg Delivery, fallback Codec) (T, error) {
+	var target T
+	codec := fallback
+	if msg.ContentType != "" {
+		var err error
+		codec, err = CodecFor(msg.ContentType)
+		if err != nil {
+			return target, err
+		}
+	}
+	if v, ok, err := upcast[T](msg, codec); ok {
+		return v, err
+	}
+	err := codec.Unmarshal(msg.Body, &target)
+	return target, err
 }
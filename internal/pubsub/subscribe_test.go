@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keysOnDifferentWorkers returns two routing keys that dispatch hands to
+// different workers out of n.
+func keysOnDifferentWorkers(t *testing.T, n int) (string, string) {
+	t.Helper()
+	worker := func(key string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return h.Sum32() % uint32(n)
+	}
+	first := "army_moves.alice"
+	for i := range 100 {
+		key := fmt.Sprintf("army_moves.player%d", i)
+		if worker(key) != worker(first) {
+			return first, key
+		}
+	}
+	t.Fatal("no two keys on different workers")
+	return "", ""
+}
+
+func TestKeyOrderingKeepsPerKeyOrder(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "topic", Kind: ExchangeTopic}))
+	alice, bob := keysOnDifferentWorkers(t, 4)
+
+	const perKey = 50
+	var mu sync.Mutex
+	got := map[string][]int{}
+	var wg sync.WaitGroup
+	wg.Add(2 * perKey)
+	handler := func(ctx context.Context, msg Message[int]) AckType {
+		defer wg.Done()
+		if msg.Body%7 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		got[msg.RoutingKey] = append(got[msg.RoutingKey], msg.Body)
+		mu.Unlock()
+		return Ack
+	}
+	sub, err := Subscribe(context.Background(), b, "topic", "moves", "army_moves.*", QueueDurable, handler,
+		WithWorkers(4), WithKeyOrdering(), WithPrefetch(2*perKey))
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	for i := range perKey {
+		mustNoErr(t, Publish(context.Background(), b, JSON, "topic", alice, i))
+		mustNoErr(t, Publish(context.Background(), b, JSON, "topic", bob, i))
+	}
+	wg.Wait()
+
+	for _, key := range []string{alice, bob} {
+		if len(got[key]) != perKey {
+			t.Fatalf("%s: handled %d messages, want %d", key, len(got[key]), perKey)
+		}
+		for i, n := range got[key] {
+			if n != i {
+				t.Fatalf("%s handled out of order: %v", key, got[key])
+			}
+		}
+	}
+}
+
+func TestKeyOrderingRunsDifferentKeysConcurrently(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "topic", Kind: ExchangeTopic}))
+	alice, bob := keysOnDifferentWorkers(t, 4)
+
+	// Each handler waits for the other key's handler to start, which only
+	// happens if the two keys are handled at the same time.
+	started := map[string]chan struct{}{alice: make(chan struct{}), bob: make(chan struct{})}
+	other := map[string]string{alice: bob, bob: alice}
+	results := make(chan error, 2)
+	handler := func(ctx context.Context, msg Message[string]) AckType {
+		key := msg.RoutingKey
+		close(started[key])
+		select {
+		case <-started[other[key]]:
+			results <- nil
+		case <-time.After(time.Second):
+			results <- fmt.Errorf("%s never ran alongside %s", key, other[key])
+		}
+		return Ack
+	}
+	sub, err := Subscribe(context.Background(), b, "topic", "moves", "army_moves.*", QueueDurable, handler,
+		WithWorkers(4), WithKeyOrdering())
+	mustNoErr(t, err)
+	defer sub.Close()
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "topic", alice, "europe"))
+	mustNoErr(t, Publish(context.Background(), b, JSON, "topic", bob, "asia"))
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+}
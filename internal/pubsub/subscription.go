@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainTimeout is how long handlers get to finish in-flight deliveries after
+// Close before their contexts are cancelled too.
+const drainTimeout = 10 * time.Second
+
+// Subscription is a running consumer. Close cancels it on the broker, waits
+// for deliveries already in flight to be handled and then releases it.
+type Subscription struct {
+	consumer Consumer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// handlerCtx outlives ctx so that handlers can finish their work while
+	// the subscription drains.
+	handlerCtx    context.Context
+	handlerCancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+func newSubscription(ctx context.Context, consumer Consumer) *Subscription {
+	handlerCtx, handlerCancel := context.WithCancel(context.WithoutCancel(ctx))
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		consumer:      consumer,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		handlerCtx:    handlerCtx,
+		handlerCancel: handlerCancel,
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.setErr(consumer.Cancel())
+		case <-s.done:
+			return
+		}
+		select {
+		case <-time.After(drainTimeout):
+			handlerCancel()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// finish is called by the delivery loop once the consumer stops delivering.
+func (s *Subscription) finish() {
+	if s.ctx.Err() == nil {
+		s.setErr(ErrSubscriptionClosed)
+	}
+	s.setErr(s.consumer.Close())
+	s.cancel()
+	s.handlerCancel()
+	close(s.done)
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return s.Err()
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseLetsInFlightHandlersFinish(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	started := make(chan struct{})
+	ctxErr := make(chan error, 1)
+	handler := func(ctx context.Context, msg Message[string]) AckType {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		ctxErr <- ctx.Err()
+		return Ack
+	}
+	sub, err := Subscribe(context.Background(), b, "direct", "q", "k", QueueDurable, handler)
+	mustNoErr(t, err)
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "hello"))
+	<-started
+	err = sub.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ctxErr:
+		if err != nil {
+			t.Errorf("handler context cancelled during the drain: %v", err)
+		}
+	default:
+		t.Fatal("Close returned before the handler finished")
+	}
+	if _, ok, _ := b.Get("q"); ok {
+		t.Error("drained message was not acked")
+	}
+}
+
+func TestRetryDuringDrainIsScheduled(t *testing.T) {
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(ctx context.Context, msg Message[string]) AckType {
+		close(started)
+		<-release
+		return NackRetry
+	}
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: time.Minute, MaxDelay: time.Minute, Multiplier: 1}
+	sub, err := Subscribe(ctx, b, "direct", "q", "k", QueueDurable, handler, WithRetry(policy))
+	mustNoErr(t, err)
+
+	mustNoErr(t, Publish(context.Background(), b, JSON, "direct", "k", "hello"))
+	<-started
+	cancel()
+	close(release)
+	mustNoErr(t, sub.Close())
+
+	d, ok, err := b.Get("q.retry.60000")
+	mustNoErr(t, err)
+	if !ok {
+		t.Fatal("retry copy not published once the subscription's context was cancelled")
+	}
+	if d.Headers[HeaderRetryCount] != int64(1) {
+		t.Errorf("retry count %v, want 1", d.Headers[HeaderRetryCount])
+	}
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// perilTopology reads the routing names on every call, since config may have
+// renamed them after this package was initialised.
+func perilTopology() ([]ExchangeSpec, QueueSpec) {
+	exchanges := []ExchangeSpec{
+		{Name: routing.ExchangePerilDirect, Kind: ExchangeDirect, Durable: true},
+		{Name: routing.ExchangePerilTopic, Kind: ExchangeTopic, Durable: true},
+		{Name: routing.ExchangePerilDLX, Kind: ExchangeFanout, Durable: true},
+	}
+	dlq := QueueSpec{Name: routing.QueuePerilDLQ, Durable: true}
+	return exchanges, dlq
+}
+
+type TopologyDrift struct {
+	Kind string
+	Name string
+	Err  error
+}
+
+func (d TopologyDrift) String() string {
+	return d.Err.Error()
+}
+
+// DeclareTopology idempotently declares the exchanges every Peril client
+// expects, plus the dead-letter queue bound to peril_dlx.
+func DeclareTopology(t Topology) error {
+	perilExchanges, perilDLQ := perilTopology()
+	for _, spec := range perilExchanges {
+		err := t.DeclareExchange(spec)
+		if err != nil {
+			return fmt.Errorf("Couldn't declare exchange %s: %w", spec.Name, err)
+		}
+	}
+
+	_, err := t.DeclareQueue(perilDLQ)
+	if err != nil {
+		return fmt.Errorf("Couldn't declare queue %s: %w", perilDLQ.Name, err)
+	}
+	err = t.BindQueue(perilDLQ.Name, "", routing.ExchangePerilDLX)
+	if err != nil {
+		return fmt.Errorf("Couldn't bind queue %s: %w", perilDLQ.Name, err)
+	}
+	return nil
+}
+
+// VerifyTopology compares the broker against what DeclareTopology would
+// create, without changing anything. Bindings can't be inspected over AMQP, so
+// only exchanges and queues are checked.
+func VerifyTopology(t Topology) ([]TopologyDrift, error) {
+	perilExchanges, perilDLQ := perilTopology()
+	var drift []TopologyDrift
+	record := func(kind, name string, err error) error {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInequivalent) {
+			drift = append(drift, TopologyDrift{Kind: kind, Name: name, Err: err})
+			return nil
+		}
+		return err
+	}
+
+	for _, spec := range perilExchanges {
+		err := record("exchange", spec.Name, t.CheckExchange(spec))
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := t.CheckQueue(perilDLQ)
+	err = record("queue", perilDLQ.Name, err)
+	if err != nil {
+		return nil, err
+	}
+	return drift, nil
+}
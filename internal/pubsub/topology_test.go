@@ -0,0 +1,56 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func renameRouting(t *testing.T) {
+	t.Helper()
+	direct, topic, dlx, dlq := routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDLX, routing.QueuePerilDLQ
+	routing.ExchangePerilDirect = "custom_direct"
+	routing.ExchangePerilTopic = "custom_topic"
+	routing.ExchangePerilDLX = "custom_dlx"
+	routing.QueuePerilDLQ = "custom_dlq"
+	t.Cleanup(func() {
+		routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDLX, routing.QueuePerilDLQ = direct, topic, dlx, dlq
+	})
+}
+
+func TestTopologyUsesConfiguredNames(t *testing.T) {
+	renameRouting(t)
+	b := NewMemoryBroker()
+
+	drift, err := VerifyTopology(b)
+	mustNoErr(t, err)
+	if len(drift) != 4 || drift[0].Name != "custom_direct" || drift[3].Name != "custom_dlq" {
+		t.Fatalf("drift on an empty broker = %v, want the four renamed entities", drift)
+	}
+
+	mustNoErr(t, DeclareTopology(b))
+	drift, err = VerifyTopology(b)
+	mustNoErr(t, err)
+	if len(drift) != 0 {
+		t.Fatalf("drift after declaring = %v", drift)
+	}
+	for _, name := range []string{"peril_direct", "peril_topic", "peril_dlx"} {
+		if _, ok := b.exchanges[name]; ok {
+			t.Errorf("default exchange %s declared despite the rename", name)
+		}
+	}
+
+	_, err = DeclareAndBind(b, routing.ExchangePerilTopic, "q", "k", QueueDurable)
+	mustNoErr(t, err)
+	mustNoErr(t, b.Publish(context.Background(), routing.ExchangePerilTopic, "k", Publishing{}))
+	d, ok, err := b.Get("q")
+	mustNoErr(t, err)
+	if !ok {
+		t.Fatal("nothing routed through the renamed topic exchange")
+	}
+	mustNoErr(t, d.Nack(false))
+	if _, ok, _ := b.Get("custom_dlq"); !ok {
+		t.Fatal("rejected message did not reach the renamed DLQ")
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func installTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return exporter
+}
+
+func TestTraceFollowsMessagesAcrossHandlers(t *testing.T) {
+	exporter := installTestTracing(t)
+	b := NewMemoryBroker()
+	mustNoErr(t, b.DeclareExchange(ExchangeSpec{Name: "direct", Kind: ExchangeDirect}))
+
+	relay, err := Subscribe(context.Background(), b, "direct", "moves", "move", QueueDurable,
+		func(ctx context.Context, msg Message[string]) AckType {
+			err := Publish(ctx, b, JSON, "direct", "war", msg.Body)
+			if err != nil {
+				return NackDiscard
+			}
+			return Ack
+		})
+	mustNoErr(t, err)
+	defer relay.Close()
+	done := make(chan struct{})
+	sink, err := Subscribe(context.Background(), b, "direct", "wars", "war", QueueDurable,
+		func(ctx context.Context, msg Message[string]) AckType {
+			close(done)
+			return Ack
+		})
+	mustNoErr(t, err)
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "move command")
+	mustNoErr(t, Publish(ctx, b, JSON, "direct", "move", "europe"))
+	root.End()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("message never reached the second handler")
+	}
+	mustNoErr(t, sink.Close())
+	mustNoErr(t, relay.Close())
+
+	// Both publishes are named after the exchange; the one made inside the
+	// first handler is the one parented by its process span.
+	var publishMove, processMoves, publishWar, processWars tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for _, s := range spans {
+		switch s.Name {
+		case "process moves":
+			processMoves = s
+		case "process wars":
+			processWars = s
+		}
+	}
+	for _, s := range spans {
+		if s.Name != "publish direct" {
+			continue
+		}
+		if s.Parent.SpanID() == processMoves.SpanContext.SpanID() {
+			publishWar = s
+		} else {
+			publishMove = s
+		}
+	}
+
+	chain := []struct {
+		name   string
+		span   tracetest.SpanStub
+		kind   trace.SpanKind
+		parent trace.SpanContext
+	}{
+		{"publish move", publishMove, trace.SpanKindProducer, root.SpanContext()},
+		{"process moves", processMoves, trace.SpanKindConsumer, publishMove.SpanContext},
+		{"publish war", publishWar, trace.SpanKindProducer, processMoves.SpanContext},
+		{"process wars", processWars, trace.SpanKindConsumer, publishWar.SpanContext},
+	}
+	for _, c := range chain {
+		if !c.span.SpanContext.IsValid() {
+			t.Fatalf("%s: span not recorded", c.name)
+		}
+		if c.span.SpanContext.TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("%s: trace ID %s, want %s", c.name, c.span.SpanContext.TraceID(), root.SpanContext().TraceID())
+		}
+		if c.span.Parent.SpanID() != c.parent.SpanID() {
+			t.Errorf("%s: parent %s, want %s", c.name, c.span.Parent.SpanID(), c.parent.SpanID())
+		}
+		if c.span.SpanKind != c.kind {
+			t.Errorf("%s: kind %v, want %v", c.name, c.span.SpanKind, c.kind)
+		}
+	}
+}
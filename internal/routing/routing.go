@@ -8,9 +8,18 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	StatusPrefix = "status"
 )
 
-const (
+// Exchange and queue names are variables so a deployment can rename them
+// through config before anything is declared.
+var (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+var (
+	QueuePerilDLQ = "peril_dlq"
 )
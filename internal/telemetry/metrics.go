@@ -0,0 +1,22 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ServeMetrics exposes the default Prometheus registry on addr at /metrics
+// until the process exits.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Metrics server stopped: %v\n", err)
+		}
+	}()
+}